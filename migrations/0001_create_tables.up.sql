@@ -0,0 +1,118 @@
+CREATE TABLE IF NOT EXISTS events (
+  id INT NOT NULL AUTO_INCREMENT,
+  creationtime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  eventtype VARCHAR(255) NOT NULL DEFAULT '',
+  docname VARCHAR(255) NOT NULL DEFAULT '',
+  classcode VARCHAR(255) NOT NULL DEFAULT '',
+  confcode VARCHAR(255) NOT NULL DEFAULT '',
+  formatcode VARCHAR(255) NOT NULL DEFAULT '',
+  facilitycode VARCHAR(255) NOT NULL DEFAULT '',
+  practicecode VARCHAR(255) NOT NULL DEFAULT '',
+  speciality VARCHAR(255) NOT NULL DEFAULT '',
+  expression VARCHAR(255) NOT NULL DEFAULT '',
+  authors VARCHAR(255) NOT NULL DEFAULT '',
+  xdspid VARCHAR(255) NOT NULL DEFAULT '',
+  xdsdocentryuid VARCHAR(255) NOT NULL DEFAULT '',
+  repositoryuniqueid VARCHAR(255) NOT NULL DEFAULT '',
+  nhsid VARCHAR(64) NOT NULL DEFAULT '',
+  user VARCHAR(255) NOT NULL DEFAULT '',
+  org VARCHAR(255) NOT NULL DEFAULT '',
+  role VARCHAR(255) NOT NULL DEFAULT '',
+  topic VARCHAR(255) NOT NULL DEFAULT '',
+  pathway VARCHAR(255) NOT NULL DEFAULT '',
+  comments TEXT,
+  version INT NOT NULL DEFAULT 0,
+  taskid INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (id),
+  KEY events_pathway_nhsid (pathway, nhsid, version),
+  KEY events_xdsdocentryuid (xdsdocentryuid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS workflows (
+  id INT NOT NULL AUTO_INCREMENT,
+  pathway VARCHAR(255) NOT NULL DEFAULT '',
+  nhsid VARCHAR(64) NOT NULL DEFAULT '',
+  created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  xdw_key VARCHAR(255) NOT NULL DEFAULT '',
+  xdw_uid VARCHAR(255) NOT NULL DEFAULT '',
+  xdw_doc MEDIUMTEXT,
+  xdw_def MEDIUMTEXT,
+  version INT NOT NULL DEFAULT 0,
+  published TINYINT(1) NOT NULL DEFAULT 0,
+  status VARCHAR(64) NOT NULL DEFAULT '',
+  PRIMARY KEY (id),
+  KEY workflows_pathway_nhsid (pathway, nhsid, version),
+  KEY workflows_xdw_key (xdw_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS workflowstate (
+  id INT NOT NULL AUTO_INCREMENT,
+  workflowid INT NOT NULL DEFAULT 0,
+  pathway VARCHAR(255) NOT NULL DEFAULT '',
+  nhsid VARCHAR(64) NOT NULL DEFAULT '',
+  version INT NOT NULL DEFAULT 0,
+  published TINYINT(1) NOT NULL DEFAULT 0,
+  created DATETIME NULL,
+  createdby VARCHAR(255) NOT NULL DEFAULT '',
+  status VARCHAR(64) NOT NULL DEFAULT '',
+  completeby DATETIME NULL,
+  lastupdate DATETIME NULL,
+  owner VARCHAR(255) NOT NULL DEFAULT '',
+  overdue VARCHAR(8) NOT NULL DEFAULT 'FALSE',
+  escalated VARCHAR(8) NOT NULL DEFAULT 'FALSE',
+  targetmet VARCHAR(8) NOT NULL DEFAULT 'FALSE',
+  inprogress VARCHAR(8) NOT NULL DEFAULT 'FALSE',
+  duration VARCHAR(255) NOT NULL DEFAULT '',
+  timeremaining VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id),
+  KEY workflowstate_workflowid (workflowid),
+  KEY workflowstate_pathway_nhsid (pathway, nhsid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+  id INT NOT NULL AUTO_INCREMENT,
+  created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  brokerref VARCHAR(255) NOT NULL DEFAULT '',
+  pathway VARCHAR(255) NOT NULL DEFAULT '',
+  topic VARCHAR(255) NOT NULL DEFAULT '',
+  expression VARCHAR(255) NOT NULL DEFAULT '',
+  email VARCHAR(255) NOT NULL DEFAULT '',
+  nhsid VARCHAR(64) NOT NULL DEFAULT '',
+  user VARCHAR(255) NOT NULL DEFAULT '',
+  org VARCHAR(255) NOT NULL DEFAULT '',
+  role VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id),
+  KEY subscriptions_pathway (pathway),
+  KEY subscriptions_expression (expression)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS xdws (
+  id INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  isxdsmeta TINYINT(1) NOT NULL DEFAULT 0,
+  xdw MEDIUMTEXT,
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS templates (
+  id INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  template MEDIUMTEXT,
+  user VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS statics (
+  id INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  content MEDIUMTEXT,
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS idmaps (
+  id INT NOT NULL AUTO_INCREMENT,
+  lid VARCHAR(255) NOT NULL DEFAULT '',
+  mid VARCHAR(255) NOT NULL DEFAULT '',
+  user VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1 @@
+ALTER TABLE workflows ADD COLUMN revision INT NOT NULL DEFAULT 0;
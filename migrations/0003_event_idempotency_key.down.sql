@@ -0,0 +1,2 @@
+ALTER TABLE events DROP INDEX events_idempotencykey;
+ALTER TABLE events DROP COLUMN idempotencykey;
@@ -0,0 +1,2 @@
+ALTER TABLE events ADD COLUMN idempotencykey VARCHAR(255) NULL DEFAULT NULL;
+ALTER TABLE events ADD UNIQUE KEY events_idempotencykey (idempotencykey);
@@ -0,0 +1,5 @@
+ALTER TABLE workflowstate DROP INDEX workflowstate_workflowid_unique;
+ALTER TABLE idmaps DROP INDEX idmaps_user_lid;
+ALTER TABLE statics DROP INDEX statics_name;
+ALTER TABLE templates DROP INDEX templates_name_user;
+ALTER TABLE xdws DROP INDEX xdws_name_isxdsmeta;
@@ -0,0 +1,13 @@
+-- Duplicate rows are removed before each unique key is added, keeping the row with the highest id, which is the most recently persisted.
+-- Adding a key that already exists is ignored by Migrate, so if the migration stops part way through it can be run again.
+-- If a key still cannot be added, remove the remaining duplicates by hand and run Migrate again.
+DELETE a FROM xdws a JOIN xdws b ON a.name = b.name AND a.isxdsmeta = b.isxdsmeta AND a.id < b.id;
+ALTER TABLE xdws ADD UNIQUE KEY xdws_name_isxdsmeta (name, isxdsmeta);
+DELETE a FROM templates a JOIN templates b ON a.name = b.name AND a.user = b.user AND a.id < b.id;
+ALTER TABLE templates ADD UNIQUE KEY templates_name_user (name, user);
+DELETE a FROM statics a JOIN statics b ON a.name = b.name AND a.id < b.id;
+ALTER TABLE statics ADD UNIQUE KEY statics_name (name);
+DELETE a FROM idmaps a JOIN idmaps b ON a.user = b.user AND a.lid = b.lid AND a.id < b.id;
+ALTER TABLE idmaps ADD UNIQUE KEY idmaps_user_lid (user, lid);
+DELETE a FROM workflowstate a JOIN workflowstate b ON a.workflowid = b.workflowid AND a.id < b.id;
+ALTER TABLE workflowstate ADD UNIQUE KEY workflowstate_workflowid_unique (workflowid);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS eventacks (
+  id INT NOT NULL AUTO_INCREMENT,
+  created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  eventid INT NOT NULL,
+  user VARCHAR(255) NOT NULL DEFAULT '',
+  org VARCHAR(255) NOT NULL DEFAULT '',
+  role VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id),
+  UNIQUE KEY eventacks_eventid_user (eventid, user, org, role),
+  KEY eventacks_user (user, org, role)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
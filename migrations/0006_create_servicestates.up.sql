@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS servicestates (
+  id INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  state MEDIUMTEXT,
+  revision INT NOT NULL DEFAULT 0,
+  lastupdate TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  UNIQUE KEY servicestates_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
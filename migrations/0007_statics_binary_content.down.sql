@@ -0,0 +1,3 @@
+ALTER TABLE statics DROP COLUMN checksum;
+ALTER TABLE statics DROP COLUMN contenttype;
+ALTER TABLE statics MODIFY content MEDIUMTEXT;
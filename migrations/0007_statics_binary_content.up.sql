@@ -0,0 +1,3 @@
+ALTER TABLE statics MODIFY content MEDIUMBLOB;
+ALTER TABLE statics ADD COLUMN contenttype VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE statics ADD COLUMN checksum CHAR(64) NOT NULL DEFAULT '';
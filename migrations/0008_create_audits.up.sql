@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS audits (
+  id INT NOT NULL AUTO_INCREMENT,
+  created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  user VARCHAR(255) NOT NULL DEFAULT '',
+  org VARCHAR(255) NOT NULL DEFAULT '',
+  role VARCHAR(255) NOT NULL DEFAULT '',
+  action VARCHAR(32) NOT NULL DEFAULT '',
+  tablename VARCHAR(64) NOT NULL DEFAULT '',
+  rowid INT NOT NULL DEFAULT 0,
+  nhsid VARCHAR(255) NOT NULL DEFAULT '',
+  oldvalues MEDIUMTEXT,
+  newvalues MEDIUMTEXT,
+  PRIMARY KEY (id),
+  KEY audits_nhsid (nhsid, created),
+  KEY audits_user (user, created),
+  KEY audits_created (created),
+  KEY audits_table_rowid (tablename, rowid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS pullpointmessages;
+DROP TABLE IF EXISTS pullpoints;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS pullpoints (
+  id INT NOT NULL AUTO_INCREMENT,
+  created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  endpoint VARCHAR(255) NOT NULL,
+  expiry INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (id),
+  UNIQUE KEY pullpoints_endpoint (endpoint)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE IF NOT EXISTS pullpointmessages (
+  id INT NOT NULL AUTO_INCREMENT,
+  created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  pullpointid INT NOT NULL,
+  message MEDIUMTEXT,
+  expires DATETIME NULL,
+  acked DATETIME NULL,
+  PRIMARY KEY (id),
+  KEY pullpointmessages_pullpointid (pullpointid, acked, id),
+  KEY pullpointmessages_expires (expires)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
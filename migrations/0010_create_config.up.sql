@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS config (
+  id INT NOT NULL AUTO_INCREMENT,
+  service VARCHAR(128) NOT NULL DEFAULT '',
+  org VARCHAR(128) NOT NULL DEFAULT '',
+  user VARCHAR(128) NOT NULL DEFAULT '',
+  name VARCHAR(255) NOT NULL,
+  value MEDIUMTEXT,
+  lastupdate TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  UNIQUE KEY config_scope_name (service, org, user, name),
+  KEY config_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1 @@
+ALTER TABLE events DROP INDEX events_nhsid_creationtime;
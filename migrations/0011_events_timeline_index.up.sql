@@ -0,0 +1 @@
+ALTER TABLE events ADD KEY events_nhsid_creationtime (nhsid, creationtime);
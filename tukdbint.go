@@ -2,15 +2,28 @@ package tukdbint
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/ipthomas/tukcnst"
 )
 
@@ -32,9 +45,18 @@ type Statics struct {
 	Static       []Static `json:"static"`
 }
 type Static struct {
-	Id      int    `json:"id"`
-	Name    string `json:"name"`
-	Content string `json:"content"`
+	Id          int    `json:"id"`
+	Name        string `json:"name"`
+	Content     []byte `json:"content"`
+	ContentType string `json:"contenttype"`
+	Checksum    string `json:"checksum"`
+}
+
+// DBTime is a nullable UTC time column, an RFC3339 string (or empty) in JSON. Set Null to write or match NULL
+type DBTime struct {
+	Time  time.Time
+	Valid bool
+	Null  bool
 }
 type Templates struct {
 	Action       string     `json:"action"`
@@ -50,7 +72,7 @@ type Template struct {
 }
 type Subscription struct {
 	Id         int    `json:"id"`
-	Created    string `json:"created"`
+	Created    DBTime `json:"created"`
 	BrokerRef  string `json:"brokerref"`
 	Pathway    string `json:"pathway"`
 	Topic      string `json:"topic"`
@@ -69,7 +91,7 @@ type Subscriptions struct {
 }
 type Event struct {
 	Id                 int    `json:"id"`
-	Creationtime       string `json:"creationtime"`
+	Creationtime       DBTime `json:"creationtime"`
 	EventType          string `json:"eventtype"`
 	DocName            string `json:"docname"`
 	ClassCode          string `json:"classcode"`
@@ -92,7 +114,118 @@ type Event struct {
 	Comments           string `json:"comments"`
 	Version            int    `json:"ver"`
 	TaskId             int    `json:"taskid"`
-	BrokerRef          string `json:"brokerref"`
+	BrokerRef          string `json:"brokerref" db:"-"`
+	IdempotencyKey     string `json:"idempotencykey"`
+}
+
+// TimelineFilter restricts a patient timeline to events created from From until To with one of EventTypes. Zero times and empty EventTypes are ignored
+type TimelineFilter struct {
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	EventTypes []string  `json:"eventtypes"`
+}
+
+// Timeline is every event of a patient, oldest first, and the same events grouped by pathway and workflow version
+type Timeline struct {
+	NHSId    string            `json:"nhsid"`
+	Events   []Event           `json:"events"`
+	Pathways []TimelinePathway `json:"pathways"`
+}
+type TimelinePathway struct {
+	Pathway  string            `json:"pathway"`
+	Versions []TimelineVersion `json:"versions"`
+}
+type TimelineVersion struct {
+	Version    int     `json:"version"`
+	WorkflowId int     `json:"workflowid"`
+	Status     string  `json:"status"`
+	Events     []Event `json:"events"`
+}
+
+// EventFilter selects events for SelectEvents and EventWatcher. Empty strings, ids of 0 and nil pointers match any value
+type EventFilter struct {
+	Id             int    `json:"id"`
+	EventType      string `json:"eventtype"`
+	XdsDocEntryUid string `json:"xdsdocentryuid"`
+	NhsId          string `json:"nhsid"`
+	User           string `json:"user"`
+	Org            string `json:"org"`
+	Role           string `json:"role"`
+	Topic          string `json:"topic"`
+	Pathway        string `json:"pathway"`
+	Expression     string `json:"expression"`
+	IdempotencyKey string `json:"idempotencykey"`
+	Version        *int   `json:"ver"`
+	TaskId         *int   `json:"taskid"`
+}
+
+// WorkflowFilter selects workflows for SelectWorkflows, see EventFilter
+type WorkflowFilter struct {
+	Id        int    `json:"id"`
+	Pathway   string `json:"pathway"`
+	NHSId     string `json:"nhsid"`
+	XDW_Key   string `json:"xdw_key"`
+	XDW_UID   string `json:"xdw_uid"`
+	Status    string `json:"status"`
+	Version   *int   `json:"version"`
+	Published *bool  `json:"published"`
+}
+
+// WorkflowstateFilter selects workflowstates for SelectWorkflowStates, see EventFilter
+type WorkflowstateFilter struct {
+	Id         int    `json:"id"`
+	WorkflowId int    `json:"workflowid"`
+	Pathway    string `json:"pathway"`
+	NHSId      string `json:"nhsid"`
+	CreatedBy  string `json:"createdby"`
+	Status     string `json:"status"`
+	Owner      string `json:"owner"`
+	Version    *int   `json:"version"`
+	Published  *bool  `json:"published"`
+}
+
+// XDWFilter selects xdws for SelectXDWs, see EventFilter
+type XDWFilter struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	IsXDSMeta *bool  `json:"isxdsmeta"`
+}
+
+// EventWatcher polls for events matching Filter with an id greater than the last one delivered, see Watch
+type EventWatcher struct {
+	// Name identifies the watcher checkpoint
+	Name   string
+	Filter EventFilter
+	// StartId is the id after which events are delivered when there is no checkpoint
+	StartId int
+	// Interval is the delay between polls that find no new events, default 1 second
+	Interval time.Duration
+	// BatchSize is the maximum number of events read by each poll, default 100
+	BatchSize int
+	// Lag is how long a gap in the event ids is waited for before it is skipped, default 30 seconds
+	Lag time.Duration
+	// Checkpoints, if set, stores the id of the last event delivered
+	Checkpoints CheckpointStore
+}
+
+// CheckpointStore persists the position of an EventWatcher. GetCheckpoint returns false if no checkpoint has been set for name
+type CheckpointStore interface {
+	GetCheckpoint(name string) (int, bool, error)
+	SetCheckpoint(name string, id int) error
+}
+
+// ServiceStateCheckpoints is a CheckpointStore keeping checkpoints in the servicestates table, using the checkpoint name as the service name
+type ServiceStateCheckpoints struct{}
+type watchId struct {
+	Id      int
+	Settled bool
+}
+type EventDuplicate struct {
+	XdsDocEntryUid string `json:"xdsdocentryuid"`
+	EventType      string `json:"eventtype"`
+	TaskId         int    `json:"taskid"`
+	Count          int    `json:"count"`
+	Ids            string `json:"ids"`
 }
 type Events struct {
 	Action       string  `json:"action"`
@@ -100,9 +233,125 @@ type Events struct {
 	Count        int     `json:"count"`
 	Events       []Event `json:"events"`
 }
+type EventAcks struct {
+	Action       string     `json:"action"`
+	LastInsertId int        `json:"lastinsertid"`
+	Count        int        `json:"count"`
+	EventAcks    []EventAck `json:"eventacks"`
+}
+type EventAck struct {
+	Id      int    `json:"id"`
+	Created DBTime `json:"created"`
+	EventId int    `json:"eventid"`
+	User    string `json:"user"`
+	Org     string `json:"org"`
+	Role    string `json:"role"`
+}
+type Audits struct {
+	Action       string  `json:"action"`
+	LastInsertId int     `json:"lastinsertid"`
+	Count        int     `json:"count"`
+	Audits       []Audit `json:"audits"`
+}
+type Audit struct {
+	Id        int    `json:"id"`
+	Created   DBTime `json:"created"`
+	User      string `json:"user"`
+	Org       string `json:"org"`
+	Role      string `json:"role"`
+	Action    string `json:"action"`
+	TableName string `json:"tablename"`
+	RowId     int    `json:"rowid"`
+	NHSId     string `json:"nhsid"`
+	OldValues string `json:"oldvalues"`
+	NewValues string `json:"newvalues"`
+}
+
+// Actor identifies the user, org and role making a change, for the audit trail
+type Actor struct {
+	User string `json:"user"`
+	Org  string `json:"org"`
+	Role string `json:"role"`
+}
+type actorKey struct{}
+type PullPoints struct {
+	Action       string      `json:"action"`
+	LastInsertId int         `json:"lastinsertid"`
+	Count        int         `json:"count"`
+	PullPoints   []PullPoint `json:"pullpoints"`
+}
+
+// PullPoint is a DSUB pull point holding notification messages for a consumer endpoint. Expiry is the number of seconds messages are kept, 0 keeps them until deleted
+type PullPoint struct {
+	Id       int    `json:"id"`
+	Created  DBTime `json:"created"`
+	Endpoint string `json:"endpoint"`
+	Expiry   int    `json:"expiry"`
+}
+type PullPointMessages struct {
+	Action            string             `json:"action"`
+	LastInsertId      int                `json:"lastinsertid"`
+	Count             int                `json:"count"`
+	PullPointMessages []PullPointMessage `json:"pullpointmessages"`
+}
+type PullPointMessage struct {
+	Id          int    `json:"id"`
+	Created     DBTime `json:"created"`
+	PullPointId int    `json:"pullpointid"`
+	Message     string `json:"message"`
+	Expires     DBTime `json:"expires"`
+	Acked       DBTime `json:"acked"`
+}
+type Configs struct {
+	Action       string   `json:"action"`
+	LastInsertId int      `json:"lastinsertid"`
+	Count        int      `json:"count"`
+	Configs      []Config `json:"configs"`
+}
+
+// Config is a configuration value, applying globally or to a service, org and/or user. Empty scope fields match any
+type Config struct {
+	Id         int    `json:"id"`
+	Service    string `json:"service"`
+	Org        string `json:"org"`
+	User       string `json:"user"`
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+	LastUpdate DBTime `json:"lastupdate"`
+}
+
+// ConfigScope selects the config values for a service, org and user. User values take precedence over org, then service, then global values
+type ConfigScope struct {
+	Service string `json:"service"`
+	Org     string `json:"org"`
+	User    string `json:"user"`
+}
+
+// ConfigWatcher polls the config table for changes to the values applying to Scope, notifying subscribers in-process
+type ConfigWatcher struct {
+	Scope ConfigScope
+	// Interval is the delay between polls, default 1 second
+	Interval time.Duration
+	mu       sync.Mutex
+	subs     map[string][]func(Config)
+	values   map[string]Config
+}
+type ServiceStates struct {
+	Action        string         `json:"action"`
+	LastInsertId  int            `json:"lastinsertid"`
+	Count         int            `json:"count"`
+	ServiceStates []ServiceState `json:"servicestates"`
+}
+type ServiceState struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Revision   int    `json:"revision"`
+	LastUpdate DBTime `json:"lastupdate"`
+}
 type Workflow struct {
 	Id        int    `json:"id"`
-	Created   string `json:"created"`
+	Created   DBTime `json:"created"`
 	Pathway   string `json:"pathway"`
 	NHSId     string `json:"nhsid"`
 	XDW_Key   string `json:"xdw_key"`
@@ -112,6 +361,7 @@ type Workflow struct {
 	Version   int    `json:"version"`
 	Published bool   `json:"published"`
 	Status    string `json:"status"`
+	Revision  int    `json:"revision"`
 }
 type Workflows struct {
 	Action       string     `json:"action"`
@@ -132,11 +382,11 @@ type Workflowstate struct {
 	NHSId         string `json:"nhsid"`
 	Version       int    `json:"version"`
 	Published     bool   `json:"published"`
-	Created       string `json:"created"`
+	Created       DBTime `json:"created"`
 	CreatedBy     string `json:"createdby"`
 	Status        string `json:"status"`
-	CompleteBy    string `json:"completeby"`
-	LastUpdate    string `json:"lastupdate"`
+	CompleteBy    DBTime `json:"completeby"`
+	LastUpdate    DBTime `json:"lastupdate"`
 	Owner         string `json:"owner"`
 	Overdue       string `json:"overdue"`
 	Escalated     string `json:"escalated"`
@@ -145,6 +395,49 @@ type Workflowstate struct {
 	Duration      string `json:"duration"`
 	TimeRemaining string `json:"timeremaining"`
 }
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+type SchemaMismatch struct {
+	Table   string `json:"table"`
+	Column  string `json:"column"`
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+type SchemaReport struct {
+	Mismatches []SchemaMismatch `json:"mismatches"`
+}
+type DBTx struct {
+	tx  *sql.Tx
+	ctx context.Context
+	// Actor is recorded in the audit trail for changes made in the transaction. It is taken from the WithTxContext context, see ContextWithActor
+	Actor Actor
+}
+
+// DBError wraps an error returned by the database, or raised by tukdbint, with the sentinel error describing its Kind so callers can test it with errors.Is
+type DBError struct {
+	Kind error
+	Err  error
+}
+type ConflictError struct {
+	Table           string
+	Revision        int
+	CurrentRevision int
+}
+type workflowVersion struct {
+	Id       int
+	Version  int
+	Revision int
+}
+type WorkflowBundle struct {
+	Workflow      Workflow       `json:"workflow"`
+	Events        []Event        `json:"events"`
+	Workflowstate Workflowstate  `json:"workflowstate"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
 
 type XDWS struct {
 	Action       string `json:"action"`
@@ -173,10 +466,88 @@ type IdMap struct {
 	Mid  string `json:"mid"`
 }
 
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+	ErrTimeout    = errors.New("timeout")
+	ErrConnection = errors.New("connection failed")
+	ErrRowLocked  = fmt.Errorf("%w - row is locked by another transaction", ErrConflict)
+)
+
+// schemaStructs maps each table to the struct its rows are scanned into
+var schemaStructs = map[string]reflect.Type{
+	tukcnst.EVENTS:         reflect.TypeOf(Event{}),
+	tukcnst.WORKFLOWS:      reflect.TypeOf(Workflow{}),
+	WORKFLOWSTATE:          reflect.TypeOf(Workflowstate{}),
+	tukcnst.SUBSCRIPTIONS:  reflect.TypeOf(Subscription{}),
+	tukcnst.XDWS:           reflect.TypeOf(XDW{}),
+	tukcnst.TEMPLATES:      reflect.TypeOf(Template{}),
+	tukcnst.STATICS:        reflect.TypeOf(Static{}),
+	tukcnst.ID_MAPS:        reflect.TypeOf(IdMap{}),
+	tukcnst.EVENT_ACKS:     reflect.TypeOf(EventAck{}),
+	tukcnst.SERVICE_STATES: reflect.TypeOf(ServiceState{}),
+	tukcnst.AUDITS:         reflect.TypeOf(Audit{}),
+	tukcnst.CONFIG:         reflect.TypeOf(Config{}),
+	tukcnst.PULLPOINTS:     reflect.TypeOf(PullPoint{}),
+	PULLPOINT_MESSAGES:     reflect.TypeOf(PullPointMessage{}),
+}
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
 var (
 	DBConn       *sql.DB
 	cachedIDMaps = []IdMap{}
 	cached       time.Time
+	// AuditEnabled controls whether changes are recorded in the audits table. Auditing only starts once the audits table (migration 0008) is found to exist. An audited change needs an actor, either the Actor of the DBTx (see ContextWithActor) or the user of the changed row, otherwise it fails with ErrValidation
+	AuditEnabled = true
+	// auditTable caches whether the audits table exists, see auditing
+	auditTable struct {
+		sync.Mutex
+		checked bool
+		exists  bool
+	}
+	// unauditedTables hold internal bookkeeping rather than clinical or configuration data, so changes to them are not audited
+	unauditedTables = map[string]bool{
+		tukcnst.AUDITS:         true,
+		tukcnst.SERVICE_STATES: true,
+		PULLPOINT_MESSAGES:     true,
+	}
+	// unauditedColumns are computed columns left out of audit entries
+	unauditedColumns = map[string][]string{
+		WORKFLOWSTATE: {"overdue", "targetmet", "inprogress", "duration", "timeremaining"},
+	}
+)
+
+// WORKFLOWSTATE is the workflowstate table name, which tukcnst does not define
+const WORKFLOWSTATE = "workflowstate"
+
+// PULLPOINT_MESSAGES is the table holding the messages of each pull point, which tukcnst does not define
+const PULLPOINT_MESSAGES = "pullpointmessages"
+
+// TaskEventTypes are the XDW task event types, for filtering a Timeline to task events
+var TaskEventTypes = []string{
+	tukcnst.XDW_TASKEVENTTYPE_CREATE_TASK,
+	tukcnst.XDW_TASKEVENTTYPE_WORKFLOW_COMPLETED,
+	tukcnst.XDW_TASKEVENTTYPE_CREATED,
+	tukcnst.XDW_TASKEVENTTYPE_CLAIM,
+	tukcnst.XDW_TASKEVENTTYPE_START,
+	tukcnst.XDW_TASKEVENTTYPE_COMPLETE,
+	tukcnst.XDW_TASKEVENTTYPE_ATTACHMENT,
+	tukcnst.XDW_TASKEVENTTYPE_COMMENT,
+	tukcnst.XDW_TASKEVENTTYPE_ESCALATED,
+	tukcnst.XDW_TASKEVENTTYPE_RESERVED,
+}
+
+// subscriptionEventJoin matches events (e) to subscriptions (s) on pathway and, when set on the subscription, nhsid and expression
+const subscriptionEventJoin = "e.pathway = s.pathway AND (s.nhsid = '' OR s.nhsid IS NULL OR s.nhsid = e.nhsid) AND (s.expression = '' OR s.expression IS NULL OR s.expression = e.expression)"
+
+const (
+	maxBatchRows   = 500
+	maxBatchParams = 65535
+	// txTimeout bounds the transactions of WithTx and InsertBatch
+	txTimeout = 30 * time.Second
 )
 
 // sort interface for events
@@ -212,6 +583,7 @@ func (e Workflows) Swap(i, j int) {
 	e.Workflows[i], e.Workflows[j] = e.Workflows[j], e.Workflows[i]
 }
 
+// DBInterface is implemented by the envelope types. A SELECT appends the rows matching the first element and sets Count
 type DBInterface interface {
 	newEvent() error
 }
@@ -220,12 +592,408 @@ func NewDBEvent(i DBInterface) error {
 	return i.newEvent()
 }
 
+type DBBatchInterface interface {
+	batchParams() (string, []map[string]interface{})
+}
+
+type dbTxInterface interface {
+	execute(db dbExecutor) error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s row has been modified, expected revision %v current revision %v", e.Table, e.Revision, e.CurrentRevision)
+}
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+func (e *DBError) Error() string {
+	return e.Err.Error()
+}
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+func (e *DBError) Is(target error) bool {
+	return e.Kind != nil && (target == e.Kind || errors.Is(e.Kind, target))
+}
+func newDBError(kind error, format string, a ...interface{}) error {
+	return &DBError{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// dbError logs err and returns it as a DBError of the matching Kind. Errors that already have a Kind are returned unchanged
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	log.Println(err.Error())
+	var dberr *DBError
+	var conflict *ConflictError
+	if errors.As(err, &dberr) || errors.As(err, &conflict) {
+		return err
+	}
+	var myerr *mysql.MySQLError
+	var neterr net.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return &DBError{Kind: ErrNotFound, Err: err}
+	case isLockError(err), isDeadlockError(err):
+		return &DBError{Kind: ErrRowLocked, Err: err}
+	case isDuplicateKeyError(err):
+		return &DBError{Kind: ErrConflict, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &neterr) && neterr.Timeout():
+		return &DBError{Kind: ErrTimeout, Err: err}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &neterr):
+		return &DBError{Kind: ErrConnection, Err: err}
+	case errors.As(err, &myerr):
+		switch myerr.Number {
+		// too many connections, access denied
+		case 1040, 1044, 1045:
+			return &DBError{Kind: ErrConnection, Err: err}
+		}
+	}
+	return err
+}
+
+// checkDBConn returns an ErrConnection error if db is a nil *sql.DB, which is the case until a DBConnection has been opened
+func checkDBConn(db dbExecutor) error {
+	if conn, ok := db.(*sql.DB); ok && conn == nil {
+		return dbError(newDBError(ErrConnection, "no database connection has been opened"))
+	}
+	return nil
+}
+
+// NewDBTime returns a valid DBTime for t
+func NewDBTime(t time.Time) DBTime {
+	return DBTime{Time: t.UTC(), Valid: true}
+}
+func (t *DBTime) Scan(src interface{}) error {
+	var nt sql.NullTime
+	if err := nt.Scan(src); err != nil {
+		return err
+	}
+	t.Time, t.Valid, t.Null = nt.Time.UTC(), nt.Valid, false
+	return nil
+}
+func (t DBTime) Value() (driver.Value, error) {
+	if !t.Valid {
+		return nil, nil
+	}
+	return t.Time.UTC(), nil
+}
+func (t DBTime) String() string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.Format(time.RFC3339Nano)
+}
+func (t DBTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+func (t *DBTime) UnmarshalJSON(data []byte) error {
+	var str string
+	if string(data) == "null" {
+		*t = DBTime{Null: true}
+		return nil
+	}
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	if str == "" {
+		*t = DBTime{}
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+		if tm, err := time.Parse(layout, str); err == nil {
+			*t = NewDBTime(tm)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %s", str)
+}
+
+// dbExecutor is satisfied by *sql.DB, *sql.Tx and *DBTx
+type dbExecutor interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// PrepareContext prepares a statement in the transaction, so a DBTx can be used wherever a *sql.Tx is
+func (t *DBTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return t.tx.PrepareContext(ctx, query)
+}
+
+// Transactions
+// WithTx runs fn in a transaction with a txTimeout deadline, committing if fn returns nil and rolling back otherwise
+func WithTx(opts *sql.TxOptions, fn func(tx *DBTx) error) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), txTimeout)
+	defer cancelCtx()
+	return WithTxContext(ctx, opts, fn)
+}
+
+// WithTxContext is WithTx with the transaction bound to ctx instead of the default deadline. If ctx is cancelled or its deadline passes before fn returns, database/sql rolls the transaction back
+func WithTxContext(ctx context.Context, opts *sql.TxOptions, fn func(tx *DBTx) error) (err error) {
+	if err = checkDBConn(DBConn); err != nil {
+		return err
+	}
+	tx, err := DBConn.BeginTx(ctx, opts)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Rolling back transaction after panic - %v", p)
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			log.Printf("Rolling back transaction - %s", err.Error())
+			if rberr := tx.Rollback(); rberr != nil {
+				log.Println(rberr.Error())
+			}
+			return
+		}
+		err = dbError(tx.Commit())
+	}()
+	err = fn(&DBTx{tx: tx, ctx: ctx, Actor: ActorFromContext(ctx)})
+	return err
+}
+func (t *DBTx) NewDBEvent(i DBInterface) error {
+	if txi, ok := i.(dbTxInterface); ok {
+		return txi.execute(t)
+	}
+	return dbError(newDBError(ErrValidation, "%T cannot be used in a transaction", i))
+}
+func (t *DBTx) InsertBatch(i DBBatchInterface) ([]int, error) {
+	table, rows := i.batchParams()
+	return insertBatch(t.ctx, t, table, rows)
+}
+func (t *DBTx) SelectSubscriptions(filter Subscription) ([]Subscription, error) {
+	return selectRows(t, tukcnst.SUBSCRIPTIONS, filter)
+}
+func (t *DBTx) SelectEvents(filter EventFilter) ([]Event, error) {
+	return selectFilter[Event](t, tukcnst.EVENTS, filter)
+}
+func (t *DBTx) SelectWorkflows(filter WorkflowFilter) ([]Workflow, error) {
+	return selectFilter[Workflow](t, tukcnst.WORKFLOWS, filter)
+}
+func (t *DBTx) SelectWorkflowStates(filter WorkflowstateFilter) ([]Workflowstate, error) {
+	return selectFilter[Workflowstate](t, WORKFLOWSTATE, filter)
+}
+func (t *DBTx) SelectXDWs(filter XDWFilter) ([]XDW, error) {
+	return selectFilter[XDW](t, tukcnst.XDWS, filter)
+}
+func (t *DBTx) SelectTemplates(filter Template) ([]Template, error) {
+	return selectRows(t, tukcnst.TEMPLATES, filter)
+}
+func (t *DBTx) SelectIdMaps(filter IdMap) ([]IdMap, error) {
+	return selectRows(t, tukcnst.ID_MAPS, filter)
+}
+func (t *DBTx) SelectStatics(filter Static) ([]Static, error) {
+	return selectRows(t, tukcnst.STATICS, filter)
+}
+func (t *DBTx) SelectEventAcks(filter EventAck) ([]EventAck, error) {
+	return selectRows(t, tukcnst.EVENT_ACKS, filter)
+}
+func (t *DBTx) AckEvent(ack EventAck) error {
+	return ackEvent(t, ack)
+}
+func (t *DBTx) UnackEvent(ack EventAck) error {
+	return unackEvent(t, ack)
+}
+func (t *DBTx) GetUnackedUserEvents(user string, org string, role string) ([]Event, error) {
+	return getUnackedUserEvents(t, user, org, role)
+}
+func (t *DBTx) GetUnackedSubscriptionEvents(subid int) ([]Event, error) {
+	return getUnackedSubscriptionEvents(t, subid)
+}
+func (t *DBTx) GetServiceState(name string) (ServiceState, error) {
+	return getServiceState(t, name)
+}
+func (t *DBTx) SetServiceState(name string, state interface{}) (int, error) {
+	return setServiceState(t, name, state)
+}
+func (t *DBTx) CompareAndSwapServiceState(name string, revision int, state interface{}) (int, error) {
+	return compareAndSwapServiceState(t, name, revision, state)
+}
+func (t *DBTx) GetStatic(name string) (Static, error) {
+	return getStatic(t, name)
+}
+func (t *DBTx) GetStatics() ([]Static, error) {
+	return getStatics(t)
+}
+func (t *DBTx) PersistStatic(name string, contentType string, content []byte) (Static, error) {
+	return persistStatic(t, name, contentType, content)
+}
+func (t *DBTx) DeleteStatic(name string) error {
+	return deleteStatic(t, name)
+}
+func (t *DBTx) GetWorkflowStates(pathway string, nhsid string, owner string, status string) ([]Workflowstate, error) {
+	return getWorkflowStates(t, pathway, nhsid, owner, status)
+}
+func (t *DBTx) GetOverdueWorkflowStates(pathway string) ([]Workflowstate, error) {
+	return getOverdueWorkflowStates(t, pathway)
+}
+func (t *DBTx) GetEscalatedWorkflowStates(pathway string) ([]Workflowstate, error) {
+	return getEscalatedWorkflowStates(t, pathway)
+}
+func (t *DBTx) SetWorkflowState(wf Workflow, state Workflowstate) (Workflowstate, error) {
+	return setWorkflowState(t, wf, state)
+}
+func (t *DBTx) RefreshWorkflowStateSLAs() (int, error) {
+	return refreshWorkflowStateSLAs(t)
+}
+func (t *DBTx) SelectAudits(filter Audit) ([]Audit, error) {
+	return selectRows(t, tukcnst.AUDITS, filter)
+}
+func (t *DBTx) GetAudits(nhsid string, user string, from time.Time, to time.Time) ([]Audit, error) {
+	return getAudits(t, nhsid, user, from, to)
+}
+func (t *DBTx) SelectPullPoints(filter PullPoint) ([]PullPoint, error) {
+	return selectRows(t, tukcnst.PULLPOINTS, filter)
+}
+func (t *DBTx) SelectPullPointMessages(filter PullPointMessage) ([]PullPointMessage, error) {
+	return selectRows(t, PULLPOINT_MESSAGES, filter)
+}
+func (t *DBTx) CreatePullPoint(endpoint string, expiry time.Duration) (PullPoint, error) {
+	return createPullPoint(t, endpoint, expiry)
+}
+func (t *DBTx) GetPullPoint(endpoint string) (PullPoint, error) {
+	return getPullPoint(t, endpoint)
+}
+func (t *DBTx) DestroyPullPoint(id int) error {
+	return destroyPullPoint(t, id)
+}
+func (t *DBTx) EnqueuePullPointMessage(id int, message string) (int, error) {
+	return enqueuePullPointMessage(t, id, message)
+}
+func (t *DBTx) GetPullPointMessages(id int, n int) ([]PullPointMessage, error) {
+	return getPullPointMessages(t, id, n)
+}
+func (t *DBTx) AckPullPointMessages(id int, msgids ...int) (int, error) {
+	return ackPullPointMessages(t, id, msgids...)
+}
+func (t *DBTx) DeletePullPointMessages(id int, msgids ...int) (int, error) {
+	return deletePullPointMessages(t, id, msgids...)
+}
+func (t *DBTx) PurgePullPointMessages() (int, error) {
+	return purgePullPointMessages(t)
+}
+func (t *DBTx) SelectConfigs(filter Config) ([]Config, error) {
+	return selectRows(t, tukcnst.CONFIG, filter)
+}
+func (t *DBTx) GetConfig(scope ConfigScope, name string) (Config, error) {
+	return getConfig(t, scope, name)
+}
+func (t *DBTx) GetConfigs(scope ConfigScope) (map[string]Config, error) {
+	return getConfigs(t, scope)
+}
+func (t *DBTx) SetConfig(scope ConfigScope, name string, value interface{}) error {
+	return setConfig(t, scope, name, value)
+}
+func (t *DBTx) DeleteConfig(scope ConfigScope, name string) error {
+	return deleteConfig(t, scope, name)
+}
+func (t *DBTx) GetTimeline(nhsid string, filter TimelineFilter) (Timeline, error) {
+	return getTimeline(t, nhsid, filter)
+}
+func (t *DBTx) GetPathwaySubs(pathway string) (Subscriptions, error) {
+	return getPathwaySubs(t, pathway)
+}
+func (t *DBTx) HasBrokerSub(expression string) (bool, string, error) {
+	return hasBrokerSub(t, expression)
+}
+func (t *DBTx) HasUserSub(usersub Subscription) (bool, error) {
+	return hasUserSub(t, usersub)
+}
+func (t *DBTx) GetSubs(sub Subscription) (Subscriptions, error) {
+	return getSubs(t, sub)
+}
+func (t *DBTx) NewSub(sub Subscription) error {
+	return newSub(t, sub)
+}
+func (t *DBTx) CancelEsub(sub Subscription) (Subscriptions, error) {
+	return cancelEsub(t, sub)
+}
+func (t *DBTx) GetTaskNotes(pwy string, nhsid string, taskid int, ver int) (string, error) {
+	return getTaskNotes(t, pwy, nhsid, taskid, ver)
+}
+func (t *DBTx) InsertEventIdempotent(ev Event) (int, bool, error) {
+	return insertEventIdempotent(t, ev)
+}
+func (t *DBTx) GetWorkflows(pathway string, nhsid string, version int, status string) (Workflows, error) {
+	return getWorkflows(t, pathway, nhsid, version, status)
+}
+func (t *DBTx) UpdateWorkflow(wf Workflow) (int, error) {
+	return updateWorkflow(t, wf)
+}
+
+// GetWorkflowForUpdate reads and locks the workflow until the transaction ends, returning ErrRowLocked after timeout (0 for NOWAIT)
+func (t *DBTx) GetWorkflowForUpdate(pathway string, nhsid string, version int, timeout time.Duration) (Workflow, error) {
+	wfs, err := lockRows[Workflow](t, timeout, "SELECT * FROM workflows WHERE pathway = ? AND nhsid = ? AND version = ?", pathway, nhsid, version)
+	if err != nil {
+		return Workflow{}, err
+	}
+	if len(wfs) == 0 {
+		return Workflow{}, dbError(newDBError(ErrNotFound, "no workflow found for pathway %s nhsid %s version %v", pathway, nhsid, version))
+	}
+	return wfs[0], nil
+}
+
+// GetWorkflowstateForUpdate reads and locks the workflowstate of workflowid until the transaction ends, see GetWorkflowForUpdate
+func (t *DBTx) GetWorkflowstateForUpdate(workflowid int, timeout time.Duration) (Workflowstate, error) {
+	states, err := lockRows[Workflowstate](t, timeout, "SELECT * FROM "+WORKFLOWSTATE+" WHERE workflowid = ?", workflowid)
+	if err != nil {
+		return Workflowstate{}, err
+	}
+	if len(states) == 0 {
+		return Workflowstate{}, dbError(newDBError(ErrNotFound, "no workflowstate found for workflowid %v", workflowid))
+	}
+	return states[0], nil
+}
+func (t *DBTx) RestartWorkflow(wf Workflow) (Workflow, error) {
+	return restartWorkflow(t, wf)
+}
+func (t *DBTx) GetPathways(user string) (map[string]string, error) {
+	return getPathways(t, user)
+}
+func (t *DBTx) GetWorkflowDefinition(name string) (XDW, error) {
+	return getWorkflowDefinition(t, name)
+}
+func (t *DBTx) GetWorkflowXDSMeta(name string) (string, error) {
+	return getWorkflowXDSMeta(t, name)
+}
+func (t *DBTx) PersistWorkflowDefinition(name string, config string, isxdsmeta bool) error {
+	return persistWorkflowDefinition(t, name, config, isxdsmeta)
+}
+func (t *DBTx) PersistTemplate(user string, templatename string, templatestr string) error {
+	return persistTemplate(t, user, templatename, templatestr)
+}
+func (t *DBTx) UpsertXDW(xdw XDW) (bool, error) {
+	return upsert(t, tukcnst.XDWS, xdw, "name", "isxdsmeta")
+}
+func (t *DBTx) UpsertWorkflowstate(state Workflowstate) (bool, error) {
+	return upsert(t, WORKFLOWSTATE, state, "workflowid")
+}
+func (t *DBTx) UpsertTemplate(tmplt Template) (bool, error) {
+	return upsert(t, tukcnst.TEMPLATES, tmplt, "name", "user")
+}
+func (t *DBTx) UpsertIdMap(idmap IdMap) (bool, error) {
+	return upsert(t, tukcnst.ID_MAPS, idmap, "user", "lid")
+}
+func (t *DBTx) UpsertStatic(static Static) (bool, error) {
+	return upsert(t, tukcnst.STATICS, static, "name")
+}
+func (t *DBTx) GetIDMapsLocalId(user string, mid string) (string, error) {
+	return getIDMapsLocalId(t, user, mid)
+}
+
 // DBConnection
-func CloseDBConnection() {
+func CloseDBConnection() error {
 	if DBConn != nil {
-		DBConn.Close()
+		if err := DBConn.Close(); err != nil {
+			return dbError(err)
+		}
 		log.Println("Closed DB Connection")
 	}
+	return nil
 }
 func (i *DBConnection) newEvent() error {
 	var err error
@@ -239,10 +1007,11 @@ func (i *DBConnection) newEvent() error {
 		i.DBReadTimeout)
 	log.Printf("Opening DB Connection to mysql instance User: %s Host: %s Port: %s Name: %s", i.DBUser, i.DBHost, i.DBPort, i.DBName)
 	DBConn, err = sql.Open("mysql", dsn)
-	if err == nil {
-		log.Println("Opened Database")
+	if err != nil {
+		return dbError(&DBError{Kind: ErrConnection, Err: err})
 	}
-	return err
+	log.Println("Opened Database")
+	return nil
 }
 func (i *DBConnection) setDBCredentials() {
 	if i.DBPort == "" {
@@ -269,551 +1038,2905 @@ func (i *DBConnection) setDBCredentials() {
 }
 
 // Subscriptions
-func GetPathwaySubs(pathway string) Subscriptions {
+// SelectSubscriptions returns the subscriptions matching filter, as for the envelope SELECT action, without the filter
+func SelectSubscriptions(filter Subscription) ([]Subscription, error) {
+	return selectRows(DBConn, tukcnst.SUBSCRIPTIONS, filter)
+}
+func GetPathwaySubs(pathway string) (Subscriptions, error) {
+	return getPathwaySubs(DBConn, pathway)
+}
+func getPathwaySubs(db dbExecutor, pathway string) (Subscriptions, error) {
 	sub := Subscription{Pathway: pathway}
-	return GetSubs(sub)
+	return getSubs(db, sub)
 }
-func HasBrokerSub(expression string) (bool, string) {
-	sub := Subscription{Expression: expression, Topic: tukcnst.DSUB_TOPIC_TYPE_CODE}
-	subs := GetSubs(sub)
-	if subs.Count > 0 {
-		for _, v := range subs.Subscriptions {
-			if v.BrokerRef != "" {
-				return true, subs.Subscriptions[1].BrokerRef
-			}
+func HasBrokerSub(expression string) (bool, string, error) {
+	return hasBrokerSub(DBConn, expression)
+}
+func hasBrokerSub(db dbExecutor, expression string) (bool, string, error) {
+	subs, err := selectRows(db, tukcnst.SUBSCRIPTIONS, Subscription{Expression: expression, Topic: tukcnst.DSUB_TOPIC_TYPE_CODE})
+	for _, v := range subs {
+		if v.BrokerRef != "" {
+			return true, v.BrokerRef, nil
 		}
 	}
-	return false, ""
+	return false, "", err
+}
+func HasUserSub(usersub Subscription) (bool, error) {
+	return hasUserSub(DBConn, usersub)
 }
-func HasUserSub(usersub Subscription) bool {
-	subs := GetSubs(usersub)
-	return subs.Count == 1
+func hasUserSub(db dbExecutor, usersub Subscription) (bool, error) {
+	subs, err := selectRows(db, tukcnst.SUBSCRIPTIONS, usersub)
+	return len(subs) == 1, err
 }
-func GetSubs(sub Subscription) Subscriptions {
+func GetSubs(sub Subscription) (Subscriptions, error) {
+	return getSubs(DBConn, sub)
+}
+func getSubs(db dbExecutor, sub Subscription) (Subscriptions, error) {
 	subs := Subscriptions{Action: tukcnst.SELECT}
 	subs.Subscriptions = append(subs.Subscriptions, sub)
-	NewDBEvent(&subs)
-	return subs
+	err := subs.execute(db)
+	return subs, err
 }
 func NewSub(sub Subscription) error {
+	return newSub(DBConn, sub)
+}
+func newSub(db dbExecutor, sub Subscription) error {
 	subs := Subscriptions{Action: tukcnst.INSERT}
 	subs.Subscriptions = append(subs.Subscriptions, sub)
-	return NewDBEvent(&subs)
+	return subs.execute(db)
 }
-func CancelEsub(sub Subscription) Subscriptions {
+
+// CancelEsub deletes the subscription matching sub and returns the remaining subscriptions of the sub user, org and role
+func CancelEsub(sub Subscription) (Subscriptions, error) {
+	return cancelEsub(DBConn, sub)
+}
+func cancelEsub(db dbExecutor, sub Subscription) (Subscriptions, error) {
 	subs := Subscriptions{Action: tukcnst.DELETE}
 	subs.Subscriptions = append(subs.Subscriptions, sub)
+	if err := subs.execute(db); err != nil {
+		return subs, err
+	}
 	usersub := Subscription{User: sub.User, Org: sub.Org, Role: sub.Role}
-	return GetSubs(usersub)
+	return getSubs(db, usersub)
 }
 func (i *Subscriptions) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Subscriptions) execute(db dbExecutor) error {
 	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
 	var stmntStr = tukcnst.SQL_DEFAULT_SUBSCRIPTIONS
-	var rows *sql.Rows
 	var vals []interface{}
 	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancelCtx()
 	if len(i.Subscriptions) > 0 {
 		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.SUBSCRIPTIONS, reflectStruct(reflect.ValueOf(i.Subscriptions[0]))); err != nil {
-			log.Println(err.Error())
-			return err
+			return dbError(err)
 		}
 	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		return dbError(err)
 	}
 	defer sqlStmnt.Close()
 
 	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-		}
-
-		for rows.Next() {
-			sub := Subscription{}
-			if err := rows.Scan(&sub.Id, &sub.Created, &sub.BrokerRef, &sub.Pathway, &sub.Topic, &sub.Expression, &sub.Email, &sub.NhsId, &sub.User, &sub.Org, &sub.Role); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
-			}
-			i.Subscriptions = append(i.Subscriptions, sub)
-			i.Count = i.Count + 1
+		var subs []Subscription
+		if subs, err = scanRows[Subscription](ctx, sqlStmnt, vals); err == nil {
+			i.Subscriptions = append(i.Subscriptions, subs...)
+			i.Count = i.Count + len(subs)
 		}
 	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
 	}
 	return err
 }
 
 // Events
+// SelectEvents returns the events matching filter
+func SelectEvents(filter EventFilter) ([]Event, error) {
+	return selectFilter[Event](DBConn, tukcnst.EVENTS, filter)
+}
 func GetTaskNotes(pwy string, nhsid string, taskid int, ver int) (string, error) {
+	return getTaskNotes(DBConn, pwy, nhsid, taskid, ver)
+}
+func getTaskNotes(db dbExecutor, pwy string, nhsid string, taskid int, ver int) (string, error) {
 	notes := ""
-	evs := Events{Action: tukcnst.SELECT}
-	ev := Event{Pathway: pwy, NhsId: nhsid, TaskId: taskid, Version: ver}
-	evs.Events = append(evs.Events, ev)
-	err := NewDBEvent(&evs)
-	if err == nil && evs.Count > 0 {
-		for _, note := range evs.Events {
-			if note.Id != 0 {
-				notes = notes + note.Comments + "\n"
-			}
+	evs, err := selectRows(db, tukcnst.EVENTS, Event{Pathway: pwy, NhsId: nhsid, TaskId: taskid, Version: ver})
+	if err == nil && len(evs) > 0 {
+		for _, note := range evs {
+			notes = notes + note.Comments + "\n"
 		}
 		log.Printf("Found TaskId %v Notes %s", taskid, notes)
 	}
 	return notes, err
 }
+
+// InsertEventIdempotent inserts ev unless an event with its IdempotencyKey (or xdsdocentryuid, eventtype and taskid) exists. It returns the event id and true if ev was a duplicate
+func InsertEventIdempotent(ev Event) (int, bool, error) {
+	var id int
+	var dup bool
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = WithTx(nil, func(tx *DBTx) error {
+			var err error
+			id, dup, err = tx.InsertEventIdempotent(ev)
+			return err
+		})
+		if !isDeadlockError(err) || attempt == 3 {
+			return id, dup, err
+		}
+		log.Printf("Retrying idempotent event insert after deadlock, attempt %v", attempt)
+	}
+}
+func insertEventIdempotent(db dbExecutor, ev Event) (int, bool, error) {
+	var stmntStr string
+	var vals []interface{}
+	switch {
+	case ev.IdempotencyKey != "":
+		stmntStr = "SELECT id FROM events WHERE idempotencykey = ?"
+		vals = append(vals, ev.IdempotencyKey)
+	case ev.XdsDocEntryUid != "":
+		stmntStr = "SELECT id FROM events WHERE xdsdocentryuid = ? AND eventtype = ? AND taskid = ?"
+		vals = append(vals, ev.XdsDocEntryUid, ev.EventType, ev.TaskId)
+	default:
+		return 0, false, dbError(newDBError(ErrValidation, "idempotent event insert requires an idempotencykey or xdsdocentryuid"))
+	}
+	stmntStr = stmntStr + " ORDER BY id LIMIT 1"
+	// FOR UPDATE gap locks can deadlock concurrent inserts of the same event (1213), which are retried
+	existing, err := queryStructs[struct{ Id int }](db, stmntStr+" FOR UPDATE", vals...)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(existing) > 0 {
+		log.Printf("Event is a duplicate of event id %v", existing[0].Id)
+		return existing[0].Id, true, nil
+	}
+	evs := Events{Action: tukcnst.INSERT}
+	evs.Events = append(evs.Events, ev)
+	if err = evs.execute(db); err != nil {
+		if !isDuplicateKeyError(err) {
+			return 0, false, err
+		}
+		if existing, err = queryStructs[struct{ Id int }](db, stmntStr, vals...); err != nil || len(existing) == 0 {
+			return 0, false, err
+		}
+		log.Printf("Event is a duplicate of event id %v", existing[0].Id)
+		return existing[0].Id, true, nil
+	}
+	return evs.LastInsertId, false, nil
+}
+
+// GetDuplicateEvents reports events that share the same xdsdocentryuid, eventtype and taskid
+func GetDuplicateEvents() ([]EventDuplicate, error) {
+	return queryStructs[EventDuplicate](DBConn, "SELECT xdsdocentryuid, eventtype, taskid, COUNT(*) AS count, GROUP_CONCAT(id ORDER BY id) AS ids FROM events WHERE xdsdocentryuid <> '' GROUP BY xdsdocentryuid, eventtype, taskid HAVING COUNT(*) > 1")
+}
+
+// GetTimeline returns the events of patient nhsid matching filter, oldest first and grouped by pathway and version
+func GetTimeline(nhsid string, filter TimelineFilter) (Timeline, error) {
+	return getTimeline(DBConn, nhsid, filter)
+}
+func getTimeline(db dbExecutor, nhsid string, filter TimelineFilter) (Timeline, error) {
+	timeline := Timeline{NHSId: nhsid}
+	if nhsid == "" {
+		return timeline, dbError(newDBError(ErrValidation, "timeline requires an nhsid"))
+	}
+	stmntStr := "SELECT * FROM events WHERE nhsid = ?"
+	vals := []interface{}{nhsid}
+	if !filter.From.IsZero() {
+		stmntStr = stmntStr + " AND creationtime >= ?"
+		vals = append(vals, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		stmntStr = stmntStr + " AND creationtime < ?"
+		vals = append(vals, filter.To.UTC())
+	}
+	if len(filter.EventTypes) > 0 {
+		stmntStr = stmntStr + " AND eventtype IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(filter.EventTypes)), ", ") + ")"
+		for _, eventtype := range filter.EventTypes {
+			vals = append(vals, eventtype)
+		}
+	}
+	var err error
+	if timeline.Events, err = queryStructs[Event](db, stmntStr+" ORDER BY creationtime, id", vals...); err != nil {
+		return timeline, err
+	}
+	wfs, err := queryStructs[Workflow](db, "SELECT id, pathway, nhsid, version, status FROM workflows WHERE nhsid = ?", nhsid)
+	if err != nil {
+		return timeline, err
+	}
+	timeline.Pathways = groupTimeline(timeline.Events, wfs)
+	return timeline, nil
+}
+
+// groupTimeline groups events by pathway and version, in the order of their first event, with the id and status of the matching workflow in wfs
+func groupTimeline(events []Event, wfs []Workflow) []TimelinePathway {
+	var groups []TimelinePathway
+	workflows := make(map[string]Workflow)
+	for _, wf := range wfs {
+		workflows[wf.Pathway+"\x00"+strconv.Itoa(wf.Version)] = wf
+	}
+	pathways := make(map[string]int)
+	versions := make(map[string]int)
+	for _, ev := range events {
+		p, ok := pathways[ev.Pathway]
+		if !ok {
+			p = len(groups)
+			pathways[ev.Pathway] = p
+			groups = append(groups, TimelinePathway{Pathway: ev.Pathway})
+		}
+		key := ev.Pathway + "\x00" + strconv.Itoa(ev.Version)
+		v, ok := versions[key]
+		if !ok {
+			v = len(groups[p].Versions)
+			versions[key] = v
+			wf := workflows[key]
+			groups[p].Versions = append(groups[p].Versions, TimelineVersion{Version: ev.Version, WorkflowId: wf.Id, Status: wf.Status})
+		}
+		groups[p].Versions[v].Events = append(groups[p].Versions[v].Events, ev)
+	}
+	return groups
+}
+
+// Watch sends new events in id order until ctx is cancelled, starting after the checkpoint or StartId. A batch is checkpointed once the next is received
+func (w *EventWatcher) Watch(ctx context.Context) (<-chan Event, error) {
+	lastId := w.StartId
+	if w.Checkpoints != nil {
+		id, ok, err := w.Checkpoints.GetCheckpoint(w.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lastId = id
+		}
+	}
+	interval := w.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	batchSize := w.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	lag := w.Lag
+	if lag <= 0 {
+		lag = txTimeout
+	}
+	increments, err := queryStructs[struct{ Increment int }](DBConn, "SELECT @@auto_increment_increment AS increment")
+	if err != nil {
+		return nil, err
+	}
+	step := 1
+	if len(increments) > 0 && increments[0].Increment > 0 {
+		step = increments[0].Increment
+	}
+	params := reflectStruct(reflect.ValueOf(w.Filter))
+	stmntStr, vals, err := createPreparedStmnt(tukcnst.SELECT, tukcnst.EVENTS, params)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	if len(params) > 0 {
+		stmntStr = stmntStr + " AND id > ?"
+	} else {
+		stmntStr = stmntStr + " WHERE id > ?"
+	}
+	stmntStr = stmntStr + " AND id <= ? ORDER BY id LIMIT ?"
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		// unconfirmed is set while the last batch sent has not been followed by a receive
+		unconfirmed := false
+		checkpoint := func(id int) {
+			if w.Checkpoints != nil {
+				if err := w.Checkpoints.SetCheckpoint(w.Name, id); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
+		for {
+			ids, err := queryStructs[watchId](DBConn, "SELECT id, creationtime < NOW() - INTERVAL ? MICROSECOND AS settled FROM "+tukcnst.EVENTS+" WHERE id > ? ORDER BY id LIMIT ?", lag.Microseconds(), lastId, batchSize)
+			if err != nil {
+				log.Println(err.Error())
+			}
+			safeId := safeWatchId(lastId, step, ids)
+			more := len(ids) == batchSize && safeId == ids[len(ids)-1].Id
+			if safeId > lastId {
+				events, err := queryStructs[Event](DBConn, stmntStr, append(append([]interface{}{}, vals...), lastId, safeId, batchSize)...)
+				if err != nil {
+					log.Println(err.Error())
+					safeId = lastId
+				}
+				for e, ev := range events {
+					select {
+					case ch <- ev:
+					case <-ctx.Done():
+						return
+					}
+					if e == 0 && unconfirmed {
+						checkpoint(lastId)
+						unconfirmed = false
+					}
+				}
+				if len(events) == batchSize {
+					safeId, more = events[len(events)-1].Id, true
+				}
+				if len(events) > 0 {
+					unconfirmed = true
+				}
+				lastId = safeId
+				if !unconfirmed {
+					checkpoint(lastId)
+				}
+				if more {
+					continue
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// safeWatchId returns the last of ids before a gap, wider than step, whose next event is not yet settled
+func safeWatchId(lastId int, step int, ids []watchId) int {
+	safeId := lastId
+	for _, r := range ids {
+		if r.Id > safeId+step && !r.Settled {
+			break
+		}
+		safeId = r.Id
+	}
+	return safeId
+}
+
+// GetCheckpoint returns the event id stored as the state of service name
+func (ServiceStateCheckpoints) GetCheckpoint(name string) (int, bool, error) {
+	state, err := GetServiceState(name)
+	if errors.Is(err, ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	id := 0
+	return id, true, state.Decode(&id)
+}
+
+// SetCheckpoint stores event id as the state of service name
+func (ServiceStateCheckpoints) SetCheckpoint(name string, id int) error {
+	_, err := SetServiceState(name, id)
+	return err
+}
 func (i *Events) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Events) execute(db dbExecutor) error {
 	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
 	var stmntStr = tukcnst.SQL_DEFAULT_EVENTS
-	var rows *sql.Rows
 	var vals []interface{}
 	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancelCtx()
 	if len(i.Events) > 0 {
 		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.EVENTS, reflectStruct(reflect.ValueOf(i.Events[0]))); err != nil {
-			log.Println(err.Error())
-			return err
+			return dbError(err)
 		}
 	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		return dbError(err)
 	}
 	defer sqlStmnt.Close()
 
 	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-		}
-
-		for rows.Next() {
-			ev := Event{}
-			if err := rows.Scan(&ev.Id, &ev.Creationtime, &ev.EventType, &ev.DocName, &ev.ClassCode, &ev.ConfCode, &ev.FormatCode, &ev.FacilityCode, &ev.PracticeCode, &ev.Speciality, &ev.Expression, &ev.Authors, &ev.XdsPid, &ev.XdsDocEntryUid, &ev.RepositoryUniqueId, &ev.NhsId, &ev.User, &ev.Org, &ev.Role, &ev.Topic, &ev.Pathway, &ev.Comments, &ev.Version, &ev.TaskId); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
-			}
-			i.Events = append(i.Events, ev)
-			i.Count = i.Count + 1
+		var evs []Event
+		if evs, err = scanRows[Event](ctx, sqlStmnt, vals); err == nil {
+			i.Events = append(i.Events, evs...)
+			i.Count = i.Count + len(evs)
 		}
 	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
 	}
 	return err
 }
 
 // Workflows
+// SelectWorkflows returns the workflows matching filter
+func SelectWorkflows(filter WorkflowFilter) ([]Workflow, error) {
+	return selectFilter[Workflow](DBConn, tukcnst.WORKFLOWS, filter)
+}
 func GetWorkflows(pathway string, nhsid string, version int, status string) (Workflows, error) {
+	return getWorkflows(DBConn, pathway, nhsid, version, status)
+}
+func getWorkflows(db dbExecutor, pathway string, nhsid string, version int, status string) (Workflows, error) {
 	wfs := Workflows{Action: tukcnst.SELECT}
 	wf := Workflow{Pathway: pathway, NHSId: nhsid, Version: version, Status: status}
 	wfs.Workflows = append(wfs.Workflows, wf)
-	err := wfs.newEvent()
+	err := wfs.execute(db)
 	return wfs, err
 }
+
+// UpdateWorkflow updates the workflow if wf.Revision is current and returns the new revision, or a ConflictError
+func UpdateWorkflow(wf Workflow) (int, error) {
+	return updateWorkflow(DBConn, wf)
+}
+func updateWorkflow(db dbExecutor, wf Workflow) (int, error) {
+	wfs := Workflows{Action: tukcnst.UPDATE}
+	wfs.Workflows = append(wfs.Workflows, wf)
+	if err := wfs.execute(db); err != nil {
+		return wf.Revision, err
+	}
+	return wfs.Workflows[0].Revision, nil
+}
+
+// RestartWorkflow deprecates the workflows and events of wf and inserts wf as version 0. wf must carry the Id and Revision of the current workflow (Id 0 if none), otherwise ErrConflict is returned
+func RestartWorkflow(wf Workflow) (Workflow, error) {
+	var err error
+	err = WithTx(nil, func(tx *DBTx) error {
+		wf, err = tx.RestartWorkflow(wf)
+		return err
+	})
+	return wf, err
+}
+func restartWorkflow(db dbExecutor, wf Workflow) (Workflow, error) {
+	if wf.XDW_Key == "" || wf.Pathway == "" || wf.NHSId == "" {
+		return wf, dbError(newDBError(ErrValidation, "workflow restart requires xdw_key, pathway and nhsid"))
+	}
+	existing, err := queryStructs[workflowVersion](db, "SELECT id, version, revision FROM workflows WHERE xdw_key = ? FOR UPDATE", wf.XDW_Key)
+	if err != nil {
+		return wf, err
+	}
+	if err = checkRestart(existing, wf); err != nil {
+		return wf, err
+	}
+	wfs := Workflows{Action: tukcnst.DEPRECATE}
+	wfs.Workflows = append(wfs.Workflows, Workflow{XDW_Key: wf.XDW_Key})
+	if err := wfs.execute(db); err != nil {
+		return wf, err
+	}
+	evs := Events{Action: tukcnst.DEPRECATE}
+	evs.Events = append(evs.Events, Event{Pathway: wf.Pathway, NhsId: wf.NHSId})
+	if err := evs.execute(db); err != nil {
+		return wf, err
+	}
+	wf.Id = 0
+	wf.Created = DBTime{}
+	wf.Version = 0
+	wf.Revision = 0
+	wfs = Workflows{Action: tukcnst.INSERT}
+	wfs.Workflows = append(wfs.Workflows, wf)
+	if err := wfs.execute(db); err != nil {
+		return wf, err
+	}
+	wf.Id = wfs.LastInsertId
+	log.Printf("Restarted workflow %s new workflow id %v", wf.XDW_Key, wf.Id)
+	return wf, nil
+}
+
+// checkRestart returns an ErrConflict error unless wf is the current (version 0) workflow of existing, at the same revision
+func checkRestart(existing []workflowVersion, wf Workflow) error {
+	current := workflowVersion{}
+	for _, e := range existing {
+		if e.Version == 0 {
+			current = e
+		}
+	}
+	if wf.Id != current.Id {
+		return dbError(newDBError(ErrConflict, "workflow %s has been restarted, current workflow id %v", wf.XDW_Key, current.Id))
+	}
+	if wf.Revision != current.Revision {
+		return dbError(&ConflictError{Table: tukcnst.WORKFLOWS, Revision: wf.Revision, CurrentRevision: current.Revision})
+	}
+	return nil
+}
+
+// GetWorkflowBundle returns the workflow for pathway, nhsid and version together with its events (oldest first), its workflowstate and the subscriptions for the pathway, all read from a single consistent snapshot
+func GetWorkflowBundle(pathway string, nhsid string, version int) (WorkflowBundle, error) {
+	bundle := WorkflowBundle{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	if err := checkDBConn(DBConn); err != nil {
+		return bundle, err
+	}
+	tx, err := DBConn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return bundle, dbError(err)
+	}
+	defer tx.Rollback()
+
+	wfs, err := queryStructs[Workflow](tx, "SELECT * FROM workflows WHERE pathway = ? AND nhsid = ? AND version = ?", pathway, nhsid, version)
+	if err != nil {
+		return bundle, err
+	}
+	if len(wfs) == 0 {
+		return bundle, dbError(newDBError(ErrNotFound, "no workflow found for pathway %s nhsid %s version %v", pathway, nhsid, version))
+	}
+	bundle.Workflow = wfs[0]
+	if bundle.Events, err = queryStructs[Event](tx, "SELECT * FROM events WHERE pathway = ? AND nhsid = ? AND version = ? ORDER BY id", pathway, nhsid, version); err != nil {
+		return bundle, err
+	}
+	states, err := queryStructs[Workflowstate](tx, "SELECT * FROM "+WORKFLOWSTATE+" WHERE workflowid = ?", bundle.Workflow.Id)
+	if err != nil {
+		return bundle, err
+	}
+	if len(states) > 0 {
+		bundle.Workflowstate = states[0]
+	}
+	if bundle.Subscriptions, err = queryStructs[Subscription](tx, "SELECT * FROM subscriptions WHERE pathway = ? AND (nhsid = ? OR nhsid = '' OR nhsid IS NULL)", pathway, nhsid); err != nil {
+		return bundle, err
+	}
+	err = tx.Commit()
+	return bundle, err
+}
 func (i *Workflows) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Workflows) execute(db dbExecutor) error {
 	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
 	var stmntStr = tukcnst.SQL_DEFAULT_WORKFLOWS
-	var rows *sql.Rows
 	var vals []interface{}
 	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancelCtx()
 	if len(i.Workflows) > 0 {
 		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.WORKFLOWS, reflectStruct(reflect.ValueOf(i.Workflows[0]))); err != nil {
-			log.Println(err.Error())
-			return err
+			return dbError(err)
+		}
+		// updates depend on the revision column added by migration 0002
+		if i.Action == tukcnst.UPDATE {
+			stmntStr, vals = createWorkflowUpdateStmnt(i.Workflows[0])
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var wfs []Workflow
+		if wfs, err = scanRows[Workflow](ctx, sqlStmnt, vals); err == nil {
+			i.Workflows = append(i.Workflows, wfs...)
+			i.Count = i.Count + len(wfs)
+		}
+	} else if i.Action == tukcnst.UPDATE && len(i.Workflows) > 0 {
+		if _, err = auditedWrite(ctx, db, i.Action, stmntStr, vals, func(db dbExecutor) (int, error) {
+			return 0, updateWorkflowRevision(ctx, db, bindStmnt(ctx, db, sqlStmnt), vals, i.Workflows[0])
+		}); err == nil {
+			i.Workflows[0].Revision = i.Workflows[0].Revision + 1
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// createWorkflowUpdateStmnt returns the revision checked update of wf. The values are bound from wf itself rather than its reflected params, which omit empty strings and zero ints such as the version 0 of the current workflow
+func createWorkflowUpdateStmnt(wf Workflow) (string, []interface{}) {
+	return "UPDATE workflows SET xdw_doc = ?, published = ?, status = ?, revision = revision + 1 WHERE pathway = ? AND nhsid = ? AND version = ? AND revision = ?", []interface{}{wf.XDW_Doc, wf.Published, wf.Status, wf.Pathway, wf.NHSId, wf.Version, wf.Revision}
+}
+
+// updateWorkflowRevision executes the workflow update, which only matches the row while its revision is unchanged since wf was read. If no row is updated the current revision is returned in a ConflictError
+func updateWorkflowRevision(ctx context.Context, db dbExecutor, sqlStmnt *sql.Stmt, vals []interface{}, wf Workflow) error {
+	sqlrslt, err := sqlStmnt.ExecContext(ctx, vals...)
+	if err != nil {
+		return dbError(err)
+	}
+	cnt, err := sqlrslt.RowsAffected()
+	if err != nil {
+		return dbError(err)
+	}
+	if cnt > 0 {
+		return nil
+	}
+	revStmnt, err := db.PrepareContext(ctx, "SELECT revision FROM workflows WHERE pathway = ? AND nhsid = ? AND version = ?")
+	if err != nil {
+		return dbError(err)
+	}
+	defer revStmnt.Close()
+	current := 0
+	if err = revStmnt.QueryRowContext(ctx, wf.Pathway, wf.NHSId, wf.Version).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			err = newDBError(ErrNotFound, "no workflow found for pathway %s nhsid %s version %v", wf.Pathway, wf.NHSId, wf.Version)
 		}
+		return dbError(err)
+	}
+	return dbError(&ConflictError{Table: tukcnst.WORKFLOWS, Revision: wf.Revision, CurrentRevision: current})
+}
+
+// XDWs
+// SelectXDWs returns the xdws matching filter
+func SelectXDWs(filter XDWFilter) ([]XDW, error) {
+	return selectFilter[XDW](DBConn, tukcnst.XDWS, filter)
+}
+func GetPathways(user string) (map[string]string, error) {
+	return getPathways(DBConn, user)
+}
+func getPathways(db dbExecutor, user string) (map[string]string, error) {
+	var names = make(map[string]string)
+	xdws, err := selectRows(db, tukcnst.XDWS, XDW{IsXDSMeta: false})
+	if err != nil {
+		return names, err
+	}
+	idmaps, err := selectRows(db, tukcnst.ID_MAPS, IdMap{})
+	if err != nil {
+		return names, err
+	}
+	for _, xdw := range xdws {
+		names[xdw.Name] = strings.TrimSpace(mappedId(idmaps, user, xdw.Name))
 	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
+	log.Printf("%v Pathways Defined - %v", len(names), names)
+	return names, nil
+}
+func GetWorkflowDefinition(name string) (XDW, error) {
+	return getWorkflowDefinition(DBConn, name)
+}
+func getWorkflowDefinition(db dbExecutor, name string) (XDW, error) {
+	xdw := XDW{Name: name}
+	xdws, err := selectRows(db, tukcnst.XDWS, xdw)
+	if err != nil {
+		return xdw, err
+	}
+	if len(xdws) != 1 {
+		return xdw, dbError(newDBError(ErrNotFound, "no xdw registered for %s", name))
+	}
+	return xdws[0], nil
+}
+func GetWorkflowXDSMeta(name string) (string, error) {
+	return getWorkflowXDSMeta(DBConn, name)
+}
+func getWorkflowXDSMeta(db dbExecutor, name string) (string, error) {
+	xdws, err := selectRows(db, tukcnst.XDWS, XDW{Name: name, IsXDSMeta: true})
 	if err != nil {
-		log.Println(err.Error())
+		return "", err
+	}
+	if len(xdws) != 1 {
+		return "", dbError(newDBError(ErrNotFound, "no xdw meta registered for %s", name))
+	}
+	return xdws[0].XDW, nil
+}
+
+// PersistWorkflowDefinition creates or replaces the workflow definition, or xds meta when isxdsmeta is true, named name
+func PersistWorkflowDefinition(name string, config string, isxdsmeta bool) error {
+	return WithTx(nil, func(tx *DBTx) error {
+		return tx.PersistWorkflowDefinition(name, config, isxdsmeta)
+	})
+}
+func persistWorkflowDefinition(db dbExecutor, name string, config string, isxdsmeta bool) error {
+	return replaceRow(db, tukcnst.XDWS, map[string]interface{}{"name": name, "isxdsmeta": isxdsmeta}, map[string]interface{}{"xdw": config})
+}
+
+// UpsertXDW inserts xdw or updates the xdw with the same name and isxdsmeta (requires a unique key on name, isxdsmeta). It returns true if a new row was created
+func UpsertXDW(xdw XDW) (bool, error) {
+	return upsert(DBConn, tukcnst.XDWS, xdw, "name", "isxdsmeta")
+}
+func (i *XDWS) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *XDWS) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
 		return err
 	}
+	var stmntStr = tukcnst.SQL_DEFAULT_XDWS
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.XDW) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.XDWS, reflectStruct(reflect.ValueOf(i.XDW[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
 	defer sqlStmnt.Close()
 
 	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
+		var xdws []XDW
+		if xdws, err = scanRows[XDW](ctx, sqlStmnt, vals); err == nil {
+			i.XDW = append(i.XDW, xdws...)
+			i.Count = i.Count + len(xdws)
 		}
-		for rows.Next() {
-			workflow := Workflow{}
-			if err := rows.Scan(&workflow.Id, &workflow.Pathway, &workflow.NHSId, &workflow.Created, &workflow.XDW_Key, &workflow.XDW_UID, &workflow.XDW_Doc, &workflow.XDW_Def, &workflow.Version, &workflow.Published, &workflow.Status); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
-			}
-			i.Workflows = append(i.Workflows, workflow)
-			i.Count = i.Count + 1
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Workflowstates
+// SelectWorkflowStates returns the workflowstates matching filter
+func SelectWorkflowStates(filter WorkflowstateFilter) ([]Workflowstate, error) {
+	return selectFilter[Workflowstate](DBConn, WORKFLOWSTATE, filter)
+}
+
+// UpsertWorkflowstate inserts state or updates the state with the same workflowid (requires a unique key on workflowid). It returns true if a new row was created
+func UpsertWorkflowstate(state Workflowstate) (bool, error) {
+	return upsert(DBConn, WORKFLOWSTATE, state, "workflowid")
+}
+
+// GetWorkflowStates returns the workflowstates matching pathway, nhsid, owner and status, ignoring any that are empty. The SLA fields of the returned states are computed as of now
+func GetWorkflowStates(pathway string, nhsid string, owner string, status string) ([]Workflowstate, error) {
+	return getWorkflowStates(DBConn, pathway, nhsid, owner, status)
+}
+func getWorkflowStates(db dbExecutor, pathway string, nhsid string, owner string, status string) ([]Workflowstate, error) {
+	states, err := queryStructs[Workflowstate](db, "SELECT * FROM "+WORKFLOWSTATE+" WHERE (? = '' OR pathway = ?) AND (? = '' OR nhsid = ?) AND (? = '' OR owner = ?) AND (? = '' OR status = ?) ORDER BY lastupdate DESC", pathway, pathway, nhsid, nhsid, owner, owner, status, status)
+	return setSLAs(states, time.Now()), err
+}
+
+// GetOverdueWorkflowStates returns the open workflowstates, for pathway if not empty, whose completeby time has passed
+func GetOverdueWorkflowStates(pathway string) ([]Workflowstate, error) {
+	return getOverdueWorkflowStates(DBConn, pathway)
+}
+func getOverdueWorkflowStates(db dbExecutor, pathway string) ([]Workflowstate, error) {
+	states, err := queryStructs[Workflowstate](db, "SELECT * FROM "+WORKFLOWSTATE+" WHERE (? = '' OR pathway = ?) AND status NOT IN (?, ?) AND completeby IS NOT NULL AND completeby < UTC_TIMESTAMP() ORDER BY completeby", pathway, pathway, tukcnst.COMPLETE, tukcnst.CLOSED)
+	return setSLAs(states, time.Now()), err
+}
+
+// GetEscalatedWorkflowStates returns the workflowstates, for pathway if not empty, marked as escalated
+func GetEscalatedWorkflowStates(pathway string) ([]Workflowstate, error) {
+	return getEscalatedWorkflowStates(DBConn, pathway)
+}
+func getEscalatedWorkflowStates(db dbExecutor, pathway string) ([]Workflowstate, error) {
+	states, err := queryStructs[Workflowstate](db, "SELECT * FROM "+WORKFLOWSTATE+" WHERE (? = '' OR pathway = ?) AND escalated IN ('true', ?) ORDER BY lastupdate DESC", pathway, pathway, tukcnst.STATUS_ESCALATED)
+	return setSLAs(states, time.Now()), err
+}
+
+// SetWorkflowState writes state for wf, taking the workflow identity from wf, setting lastupdate and the SLA fields. The stored state is returned
+func SetWorkflowState(wf Workflow, state Workflowstate) (Workflowstate, error) {
+	return setWorkflowState(DBConn, wf, state)
+}
+func setWorkflowState(db dbExecutor, wf Workflow, state Workflowstate) (Workflowstate, error) {
+	if wf.Id < 1 {
+		return Workflowstate{}, dbError(newDBError(ErrValidation, "workflowstate requires a workflow id"))
+	}
+	now := time.Now()
+	state.Id = 0
+	state.WorkflowId = wf.Id
+	state.Pathway = wf.Pathway
+	state.NHSId = wf.NHSId
+	state.Version = wf.Version
+	state.Published = wf.Published
+	if state.Status == "" {
+		state.Status = wf.Status
+	}
+	if !state.Created.Valid {
+		state.Created = wf.Created
+	}
+	state.LastUpdate = NewDBTime(now)
+	state.SetSLA(now)
+	if _, err := upsert(db, WORKFLOWSTATE, state, "workflowid"); err != nil {
+		return Workflowstate{}, err
+	}
+	states, err := queryStructs[Workflowstate](db, "SELECT * FROM "+WORKFLOWSTATE+" WHERE workflowid = ?", wf.Id)
+	if err != nil {
+		return Workflowstate{}, err
+	}
+	if len(states) == 0 {
+		return Workflowstate{}, dbError(newDBError(ErrNotFound, "no workflowstate found for workflowid %v", wf.Id))
+	}
+	return states[0], nil
+}
+
+// RefreshWorkflowStateSLAs recomputes and stores the SLA fields of every open workflowstate, so readers of the table see current overdue and time remaining values. It returns the number of states updated
+func RefreshWorkflowStateSLAs() (int, error) {
+	cnt := 0
+	err := WithTx(nil, func(tx *DBTx) error {
+		var err error
+		cnt, err = tx.RefreshWorkflowStateSLAs()
+		return err
+	})
+	return cnt, err
+}
+func refreshWorkflowStateSLAs(db dbExecutor) (int, error) {
+	states, err := queryStructs[Workflowstate](db, "SELECT * FROM "+WORKFLOWSTATE+" WHERE status NOT IN (?, ?)", tukcnst.COMPLETE, tukcnst.CLOSED)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelCtx()
+	now := time.Now()
+	for _, state := range states {
+		state.SetSLA(now)
+		// only computed columns change, which are not audited
+		if _, err = execStmnt(ctx, db, "UPDATE "+WORKFLOWSTATE+" SET overdue = ?, targetmet = ?, inprogress = ?, duration = ?, timeremaining = ? WHERE id = ?", state.Overdue, state.TargetMet, state.InProgress, state.Duration, state.TimeRemaining, state.Id); err != nil {
+			return 0, dbError(err)
+		}
+	}
+	return len(states), nil
+}
+
+// SetSLA computes the SLA fields of the state as of now, taking lastupdate as the completion time of a COMPLETE or CLOSED state
+func (i *Workflowstate) SetSLA(now time.Time) {
+	complete := i.Status == tukcnst.COMPLETE || i.Status == tukcnst.CLOSED
+	end := now.UTC()
+	if complete && i.LastUpdate.Valid {
+		end = i.LastUpdate.Time
+	}
+	i.InProgress = strconv.FormatBool(!complete)
+	i.Duration = ""
+	if i.Created.Valid {
+		i.Duration = end.Sub(i.Created.Time).Round(time.Second).String()
+	}
+	if !i.CompleteBy.Valid {
+		i.Overdue = "false"
+		i.TargetMet = strconv.FormatBool(complete)
+		i.TimeRemaining = ""
+		return
+	}
+	late := end.After(i.CompleteBy.Time)
+	i.Overdue = strconv.FormatBool(!complete && late)
+	i.TargetMet = strconv.FormatBool(complete && !late)
+	i.TimeRemaining = "0s"
+	if !complete && !late {
+		i.TimeRemaining = i.CompleteBy.Time.Sub(end).Round(time.Second).String()
+	}
+}
+func setSLAs(states []Workflowstate, now time.Time) []Workflowstate {
+	for s := range states {
+		states[s].SetSLA(now)
+	}
+	return states
+}
+func (i *WorkflowStates) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *WorkflowStates) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = "SELECT * FROM " + WORKFLOWSTATE
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.Workflowstate) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, WORKFLOWSTATE, reflectStruct(reflect.ValueOf(i.Workflowstate[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var states []Workflowstate
+		if states, err = scanRows[Workflowstate](ctx, sqlStmnt, vals); err == nil {
+			i.Workflowstate = append(i.Workflowstate, states...)
+			i.Count = i.Count + len(states)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Templates
+// SelectTemplates returns the templates matching filter, see SelectSubscriptions
+func SelectTemplates(filter Template) ([]Template, error) {
+	return selectRows(DBConn, tukcnst.TEMPLATES, filter)
+}
+
+// PersistTemplate creates or replaces the template templatename of user
+func PersistTemplate(user string, templatename string, templatestr string) error {
+	return WithTx(nil, func(tx *DBTx) error {
+		return tx.PersistTemplate(user, templatename, templatestr)
+	})
+}
+func persistTemplate(db dbExecutor, user string, templatename string, templatestr string) error {
+	return replaceRow(db, tukcnst.TEMPLATES, map[string]interface{}{"name": templatename, "user": user}, map[string]interface{}{"template": templatestr})
+}
+
+// UpsertTemplate inserts tmplt or updates the template with the same name and user (requires a unique key on name, user). It returns true if a new row was created
+func UpsertTemplate(tmplt Template) (bool, error) {
+	return upsert(DBConn, tukcnst.TEMPLATES, tmplt, "name", "user")
+}
+func (i *Templates) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Templates) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = tukcnst.SQL_DEFAULT_TEMPLATES
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.Templates) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.TEMPLATES, reflectStruct(reflect.ValueOf(i.Templates[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var tmplts []Template
+		if tmplts, err = scanRows[Template](ctx, sqlStmnt, vals); err == nil {
+			i.Templates = append(i.Templates, tmplts...)
+			i.Count = i.Count + len(tmplts)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Idmaps
+// SelectIdMaps returns the idmaps matching filter, see SelectSubscriptions
+func SelectIdMaps(filter IdMap) ([]IdMap, error) {
+	return selectRows(DBConn, tukcnst.ID_MAPS, filter)
+}
+
+// GetIDMapsMappedId returns the mapped id of localid for user, falling back to the system user mapping and then to localid itself when there is no mapping. Mappings are cached for 1 minute
+func GetIDMapsMappedId(user string, localid string) (string, error) {
+	duration := time.Duration(1) * time.Minute
+	expires := cached.Add(duration)
+	if len(cachedIDMaps) == 0 || time.Now().After(expires) {
+		idmaps, err := selectRows(DBConn, tukcnst.ID_MAPS, IdMap{})
+		if err != nil {
+			return localid, err
+		}
+		cachedIDMaps = idmaps
+		cached = time.Now()
+	}
+	return mappedId(cachedIDMaps, user, localid), nil
+}
+
+// mappedId returns the mapped id of localid for user in idmaps, falling back to the system user mapping and then to localid
+func mappedId(idmaps []IdMap, user string, localid string) string {
+	if user == "" {
+		user = "system"
+	}
+	for _, v := range idmaps {
+		if v.User == user && v.Lid == localid {
+			return v.Mid
+		}
+	}
+	if user != "system" {
+		for _, v := range idmaps {
+			if v.User == "system" && v.Lid == localid {
+				return v.Mid
+			}
+		}
+	}
+	return localid
+}
+func GetIDMapsLocalId(user string, mid string) (string, error) {
+	return getIDMapsLocalId(DBConn, user, mid)
+}
+func getIDMapsLocalId(db dbExecutor, user string, mid string) (string, error) {
+	if user == "" {
+		user = "system"
+	}
+	idmaps, err := selectRows(db, tukcnst.ID_MAPS, IdMap{User: user})
+	if err != nil {
+		return mid, err
+	}
+	for _, idmap := range idmaps {
+		if idmap.Mid == mid && idmap.User == user {
+			return idmap.Lid, nil
+		}
+	}
+	return mid, nil
+}
+
+// UpsertIdMap inserts idmap or updates the idmap with the same user and lid (requires a unique key on user, lid). It returns true if a new row was created
+func UpsertIdMap(idmap IdMap) (bool, error) {
+	return upsert(DBConn, tukcnst.ID_MAPS, idmap, "user", "lid")
+}
+func (i *IdMaps) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *IdMaps) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = tukcnst.SQL_DEFAULT_IDMAPS
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.LidMap) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.ID_MAPS, reflectStruct(reflect.ValueOf(i.LidMap[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var idmaps []IdMap
+		if idmaps, err = scanRows[IdMap](ctx, sqlStmnt, vals); err == nil {
+			i.LidMap = append(i.LidMap, idmaps...)
+			i.Cnt = i.Cnt + len(idmaps)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Statics
+// SelectStatics returns the statics matching filter, see SelectSubscriptions
+func SelectStatics(filter Static) ([]Static, error) {
+	return selectRows(DBConn, tukcnst.STATICS, filter)
+}
+
+// GetStatic returns the static name including its content, or an ErrNotFound error
+func GetStatic(name string) (Static, error) {
+	return getStatic(DBConn, name)
+}
+func getStatic(db dbExecutor, name string) (Static, error) {
+	statics, err := selectRows(db, tukcnst.STATICS, Static{Name: name})
+	if err != nil {
+		return Static{}, err
+	}
+	if len(statics) == 0 {
+		return Static{}, dbError(newDBError(ErrNotFound, "no static found for %s", name))
+	}
+	return statics[0], nil
+}
+
+// GetStatics returns every static without its content
+func GetStatics() ([]Static, error) {
+	return getStatics(DBConn)
+}
+func getStatics(db dbExecutor) ([]Static, error) {
+	return queryStructs[Static](db, "SELECT id, name, contenttype, checksum FROM statics ORDER BY name")
+}
+
+// PersistStatic creates or replaces the static name with content and its checksum, see newStatic. The static is returned with its id
+func PersistStatic(name string, contentType string, content []byte) (Static, error) {
+	return persistStatic(DBConn, name, contentType, content)
+}
+func persistStatic(db dbExecutor, name string, contentType string, content []byte) (Static, error) {
+	if name == "" {
+		return Static{}, dbError(newDBError(ErrValidation, "static requires a name"))
+	}
+	static := newStatic(name, contentType, content)
+	params := reflectStruct(reflect.ValueOf(static))
+	params["content"] = static.Content
+	if err := checkDBConn(db); err != nil {
+		return static, err
+	}
+	if _, err := upsertParams(db, tukcnst.STATICS, params, []string{"name"}); err != nil {
+		return static, err
+	}
+	ids, err := queryStructs[struct{ Id int }](db, "SELECT id FROM statics WHERE name = ?", name)
+	if err != nil {
+		return static, err
+	}
+	if len(ids) > 0 {
+		static.Id = ids[0].Id
+	}
+	return static, nil
+}
+
+// newStatic returns the static name with content and its checksum. If contentType is empty it is derived from the name extension, or from the content itself
+func newStatic(name string, contentType string, content []byte) Static {
+	if contentType == "" {
+		if contentType = mime.TypeByExtension(path.Ext(name)); contentType == "" {
+			contentType = http.DetectContentType(content)
+		}
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	sum := sha256.Sum256(content)
+	return Static{Name: name, Content: content, ContentType: contentType, Checksum: hex.EncodeToString(sum[:])}
+}
+
+// DeleteStatic removes the static name
+func DeleteStatic(name string) error {
+	return deleteStatic(DBConn, name)
+}
+func deleteStatic(db dbExecutor, name string) error {
+	if name == "" {
+		return dbError(newDBError(ErrValidation, "static requires a name"))
+	}
+	statics := Statics{Action: tukcnst.DELETE}
+	statics.Static = append(statics.Static, Static{Name: name})
+	return statics.execute(db)
+}
+
+// UpsertStatic inserts static or updates the static with the same name (requires a unique key on name). It returns true if a new row was created
+func UpsertStatic(static Static) (bool, error) {
+	return upsert(DBConn, tukcnst.STATICS, static, "name")
+}
+
+// ValidChecksum reports whether the static content matches its stored checksum
+func (i Static) ValidChecksum() bool {
+	sum := sha256.Sum256(i.Content)
+	return i.Checksum == hex.EncodeToString(sum[:])
+}
+
+func (i *Statics) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Statics) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = tukcnst.SQL_DEFAULT_STATICS
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.Static) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.STATICS, reflectStruct(reflect.ValueOf(i.Static[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var statics []Static
+		if statics, err = scanRows[Static](ctx, sqlStmnt, vals); err == nil {
+			i.Static = append(i.Static, statics...)
+			i.Count = i.Count + len(statics)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// EventAcks
+// SelectEventAcks returns the eventacks matching filter, see SelectSubscriptions
+func SelectEventAcks(filter EventAck) ([]EventAck, error) {
+	return selectRows(DBConn, tukcnst.EVENT_ACKS, filter)
+}
+
+// AckEvent records that ack.User, Org and Role have acknowledged event ack.EventId. Acknowledging an event more than once has no effect
+func AckEvent(ack EventAck) error {
+	return ackEvent(DBConn, ack)
+}
+func ackEvent(db dbExecutor, ack EventAck) error {
+	if ack.EventId < 1 || ack.User == "" {
+		return dbError(newDBError(ErrValidation, "event acknowledgement requires an eventid and user"))
+	}
+	_, err := upsert(db, tukcnst.EVENT_ACKS, ack, "eventid", "user", "org", "role")
+	return err
+}
+
+// UnackEvent removes the acknowledgement of event ack.EventId by ack.User, Org and Role
+func UnackEvent(ack EventAck) error {
+	return unackEvent(DBConn, ack)
+}
+func unackEvent(db dbExecutor, ack EventAck) error {
+	if ack.EventId < 1 || ack.User == "" {
+		return dbError(newDBError(ErrValidation, "event acknowledgement requires an eventid and user"))
+	}
+	acks := EventAcks{Action: tukcnst.DELETE}
+	acks.EventAcks = append(acks.EventAcks, EventAck{EventId: ack.EventId, User: ack.User, Org: ack.Org, Role: ack.Role})
+	return acks.execute(db)
+}
+
+// GetUnackedUserEvents returns the events matching any subscription of user, org and role that they have not acknowledged, newest first
+func GetUnackedUserEvents(user string, org string, role string) ([]Event, error) {
+	return getUnackedUserEvents(DBConn, user, org, role)
+}
+func getUnackedUserEvents(db dbExecutor, user string, org string, role string) ([]Event, error) {
+	return queryStructs[Event](db, "SELECT DISTINCT e.* FROM events e JOIN subscriptions s ON "+subscriptionEventJoin+" WHERE s.user = ? AND s.org = ? AND s.role = ? AND NOT EXISTS (SELECT 1 FROM eventacks a WHERE a.eventid = e.id AND a.user = ? AND a.org = ? AND a.role = ?) ORDER BY e.id DESC", user, org, role, user, org, role)
+}
+
+// GetUnackedSubscriptionEvents returns the events matching subscription subid that the subscription user, org and role have not acknowledged, newest first
+func GetUnackedSubscriptionEvents(subid int) ([]Event, error) {
+	return getUnackedSubscriptionEvents(DBConn, subid)
+}
+func getUnackedSubscriptionEvents(db dbExecutor, subid int) ([]Event, error) {
+	return queryStructs[Event](db, "SELECT e.* FROM events e JOIN subscriptions s ON "+subscriptionEventJoin+" WHERE s.id = ? AND NOT EXISTS (SELECT 1 FROM eventacks a WHERE a.eventid = e.id AND a.user = s.user AND a.org = s.org AND a.role = s.role) ORDER BY e.id DESC", subid)
+}
+func (i *EventAcks) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *EventAcks) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = tukcnst.SQL_DEFAULT_EVENT_ACKS
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.EventAcks) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.EVENT_ACKS, reflectStruct(reflect.ValueOf(i.EventAcks[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var acks []EventAck
+		if acks, err = scanRows[EventAck](ctx, sqlStmnt, vals); err == nil {
+			i.EventAcks = append(i.EventAcks, acks...)
+			i.Count = i.Count + len(acks)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// ServiceStates
+// GetServiceState returns the state of service name, or an ErrNotFound error if no state has been set
+func GetServiceState(name string) (ServiceState, error) {
+	return getServiceState(DBConn, name)
+}
+func getServiceState(db dbExecutor, name string) (ServiceState, error) {
+	states, err := selectRows(db, tukcnst.SERVICE_STATES, ServiceState{Name: name})
+	if err != nil {
+		return ServiceState{}, err
+	}
+	if len(states) == 0 {
+		return ServiceState{}, dbError(newDBError(ErrNotFound, "no state found for service %s", name))
+	}
+	return states[0], nil
+}
+
+// SetServiceState stores state, marshalled to JSON, as the state of service name regardless of its current revision and returns the new revision. Pass a json.RawMessage to store JSON that is already encoded
+func SetServiceState(name string, state interface{}) (int, error) {
+	var rev int
+	err := WithTx(nil, func(tx *DBTx) error {
+		var err error
+		rev, err = tx.SetServiceState(name, state)
+		return err
+	})
+	return rev, err
+}
+func setServiceState(db dbExecutor, name string, state interface{}) (int, error) {
+	js, err := json.Marshal(state)
+	if err != nil {
+		return 0, dbError(&DBError{Kind: ErrValidation, Err: err})
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	sqlStmnt, err := db.PrepareContext(ctx, "INSERT INTO servicestates (name, state, revision) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE state = VALUES(state), revision = revision + 1")
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer sqlStmnt.Close()
+	if _, err = sqlStmnt.ExecContext(ctx, name, string(js)); err != nil {
+		return 0, dbError(err)
+	}
+	current, err := getServiceState(db, name)
+	return current.Revision, err
+}
+
+// CompareAndSwapServiceState stores state if the stored revision is still revision (0 to create) and returns the new revision, or a ConflictError
+func CompareAndSwapServiceState(name string, revision int, state interface{}) (int, error) {
+	return compareAndSwapServiceState(DBConn, name, revision, state)
+}
+func compareAndSwapServiceState(db dbExecutor, name string, revision int, state interface{}) (int, error) {
+	js, err := json.Marshal(state)
+	if err != nil {
+		return revision, dbError(&DBError{Kind: ErrValidation, Err: err})
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	var sqlrslt sql.Result
+	if revision == 0 {
+		sqlrslt, err = execStmnt(ctx, db, "INSERT INTO servicestates (name, state, revision) VALUES (?, ?, 1)", name, string(js))
+	} else {
+		sqlrslt, err = execStmnt(ctx, db, "UPDATE servicestates SET state = ?, revision = revision + 1 WHERE name = ? AND revision = ?", string(js), name, revision)
+	}
+	if err != nil && !isDuplicateKeyError(err) {
+		return revision, dbError(err)
+	}
+	if err == nil {
+		if cnt, err := sqlrslt.RowsAffected(); err != nil {
+			return revision, dbError(err)
+		} else if cnt > 0 {
+			return revision + 1, nil
+		}
+	}
+	current, err := getServiceState(db, name)
+	if err != nil {
+		return revision, err
+	}
+	return revision, dbError(&ConflictError{Table: tukcnst.SERVICE_STATES, Revision: revision, CurrentRevision: current.Revision})
+}
+
+// DeleteServiceState removes the state of service name
+func DeleteServiceState(name string) error {
+	states := ServiceStates{Action: tukcnst.DELETE}
+	states.ServiceStates = append(states.ServiceStates, ServiceState{Name: name})
+	return states.newEvent()
+}
+
+// Decode unmarshals the JSON state into v
+func (i ServiceState) Decode(v interface{}) error {
+	if err := json.Unmarshal([]byte(i.State), v); err != nil {
+		return dbError(&DBError{Kind: ErrValidation, Err: err})
+	}
+	return nil
+}
+func (i *ServiceStates) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *ServiceStates) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = tukcnst.SQL_DEFAULT_SERVICESTATES
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.ServiceStates) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.SERVICE_STATES, reflectStruct(reflect.ValueOf(i.ServiceStates[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var states []ServiceState
+		if states, err = scanRows[ServiceState](ctx, sqlStmnt, vals); err == nil {
+			i.ServiceStates = append(i.ServiceStates, states...)
+			i.Count = i.Count + len(states)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Audits
+// SelectAudits returns the audits matching filter, see SelectSubscriptions
+func SelectAudits(filter Audit) ([]Audit, error) {
+	return selectRows(DBConn, tukcnst.AUDITS, filter)
+}
+
+// GetAudits returns the audit trail, oldest first, for changes to rows of patient nhsid made by user between from and to. Empty arguments and zero times are ignored
+func GetAudits(nhsid string, user string, from time.Time, to time.Time) ([]Audit, error) {
+	return getAudits(DBConn, nhsid, user, from, to)
+}
+func getAudits(db dbExecutor, nhsid string, user string, from time.Time, to time.Time) ([]Audit, error) {
+	stmntStr := "SELECT * FROM " + tukcnst.AUDITS + " WHERE (? = '' OR nhsid = ?) AND (? = '' OR user = ?)"
+	vals := []interface{}{nhsid, nhsid, user, user}
+	if !from.IsZero() {
+		stmntStr = stmntStr + " AND created >= ?"
+		vals = append(vals, from.UTC())
+	}
+	if !to.IsZero() {
+		stmntStr = stmntStr + " AND created < ?"
+		vals = append(vals, to.UTC())
+	}
+	return queryStructs[Audit](db, stmntStr+" ORDER BY id", vals...)
+}
+func (i *Audits) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Audits) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = "SELECT * FROM " + tukcnst.AUDITS
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.Audits) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.AUDITS, reflectStruct(reflect.ValueOf(i.Audits[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var audits []Audit
+		if audits, err = scanRows[Audit](ctx, sqlStmnt, vals); err == nil {
+			i.Audits = append(i.Audits, audits...)
+			i.Count = i.Count + len(audits)
+		}
+	} else {
+		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+	}
+	return err
+}
+
+// auditedLastID executes an insert, update, delete or deprecate statement created by createPreparedStmnt, recording the change in the audit trail, and returns the last insert id
+func auditedLastID(ctx context.Context, db dbExecutor, action string, stmntStr string, sqlStmnt *sql.Stmt, vals []interface{}) (int, error) {
+	return auditedWrite(ctx, db, action, stmntStr, vals, func(db dbExecutor) (int, error) {
+		return setLastID(ctx, bindStmnt(ctx, db, sqlStmnt), vals)
+	})
+}
+
+// auditedWrite runs write, the execution of stmntStr, recording the rows it changes in the audit trail. The table and the WHERE clause identifying the changed rows are taken from stmntStr
+func auditedWrite(ctx context.Context, db dbExecutor, action string, stmntStr string, vals []interface{}, write func(db dbExecutor) (int, error)) (int, error) {
+	var table, where string
+	var whereVals []interface{}
+	words := strings.Fields(stmntStr)
+	switch {
+	case len(words) > 2 && (words[0] == "INSERT" || words[0] == "DELETE"):
+		table = words[2]
+	case len(words) > 1 && words[0] == "UPDATE":
+		table = words[1]
+	}
+	if n := strings.LastIndex(stmntStr, " WHERE "); n > -1 && words[0] != "INSERT" {
+		where = stmntStr[n+len(" WHERE "):]
+		if q := strings.Count(where, "?"); q <= len(vals) {
+			whereVals = vals[len(vals)-q:]
+		}
+	}
+	return auditRows(ctx, db, action, table, where, whereVals, write)
+}
+
+// auditRows runs write in a transaction, auditing the rows of table matching where (or the inserted id). write must use the executor it is passed
+func auditRows(ctx context.Context, db dbExecutor, action string, table string, where string, vals []interface{}, write func(db dbExecutor) (int, error)) (int, error) {
+	if table == "" || unauditedTables[table] {
+		return write(db)
+	}
+	if audit, err := auditing(ctx, db); err != nil || !audit {
+		if err != nil {
+			return 0, err
+		}
+		return write(db)
+	}
+	conn, ok := db.(*sql.DB)
+	if !ok {
+		return auditRowsTx(ctx, db, action, table, where, vals, write)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer tx.Rollback()
+	id, err := auditRowsTx(ctx, tx, action, table, where, vals, write)
+	if err != nil {
+		return id, err
+	}
+	return id, dbError(tx.Commit())
+}
+func auditRowsTx(ctx context.Context, db dbExecutor, action string, table string, where string, vals []interface{}, write func(db dbExecutor) (int, error)) (int, error) {
+	var err error
+	before := map[int]map[string]interface{}{}
+	if where != "" {
+		if before, err = snapshotRows(ctx, db, table, where, vals...); err != nil {
+			return 0, err
+		}
+	}
+	id, err := write(db)
+	if err != nil {
+		return id, err
+	}
+	after := map[int]map[string]interface{}{}
+	switch {
+	case action == tukcnst.DELETE:
+	case where == "":
+		after, err = snapshotRows(ctx, db, table, "id = ?", id)
+	default:
+		// updated rows may no longer match where, so they are also found by id
+		afterWhere := "(" + where + ")"
+		afterVals := append([]interface{}{}, vals...)
+		for rowid := range before {
+			afterWhere = afterWhere + " OR id = ?"
+			afterVals = append(afterVals, rowid)
+		}
+		after, err = snapshotRows(ctx, db, table, afterWhere, afterVals...)
+	}
+	if err != nil {
+		return id, err
+	}
+	return id, writeAudits(ctx, db, action, table, before, after)
+}
+
+// auditIds records an audit entry for each of the rows of table with ids, which have just been inserted by db, a transaction
+func auditIds(ctx context.Context, db dbExecutor, table string, ids []int) error {
+	if len(ids) == 0 || unauditedTables[table] {
+		return nil
+	}
+	if audit, err := auditing(ctx, db); err != nil || !audit {
+		return err
+	}
+	var vals []interface{}
+	for _, id := range ids {
+		vals = append(vals, id)
+	}
+	after, err := snapshotRows(ctx, db, table, "id IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")+")", vals...)
+	if err != nil {
+		return err
+	}
+	return writeAudits(ctx, db, tukcnst.INSERT, table, nil, after)
+}
+
+// auditing reports whether AuditEnabled and the audits table exists, looked up once per migration. A failed lookup is returned
+func auditing(ctx context.Context, db dbExecutor) (bool, error) {
+	if !AuditEnabled {
+		return false, nil
+	}
+	auditTable.Lock()
+	defer auditTable.Unlock()
+	if !auditTable.checked {
+		tables, err := queryStructsContext[struct{ Cnt int }](ctx, db, "SELECT COUNT(*) AS cnt FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?", tukcnst.AUDITS)
+		if err != nil {
+			return false, err
+		}
+		auditTable.checked = true
+		auditTable.exists = len(tables) > 0 && tables[0].Cnt > 0
+		if !auditTable.exists {
+			log.Printf("%s table not found, changes will not be audited until the schema is migrated", tukcnst.AUDITS)
+		}
+	}
+	return auditTable.exists, nil
+}
+
+// bindStmnt returns sqlStmnt bound to db when db is a transaction started by auditRows, so statements prepared on the connection run within it
+func bindStmnt(ctx context.Context, db dbExecutor, sqlStmnt *sql.Stmt) *sql.Stmt {
+	if tx, ok := db.(*sql.Tx); ok {
+		return tx.StmtContext(ctx, sqlStmnt)
+	}
+	return sqlStmnt
+}
+
+// ContextWithActor returns a copy of ctx carrying actor, which WithTxContext records as the Actor of its transaction
+func ContextWithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the Actor carried by ctx, see ContextWithActor
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// snapshotRows returns the column values of the rows of table matching where, keyed by row id. Binary columns are recorded by their length and sha256 checksum, and unauditedColumns are left out
+func snapshotRows(ctx context.Context, db dbExecutor, table string, where string, vals ...interface{}) (map[int]map[string]interface{}, error) {
+	snapshots := map[int]map[string]interface{}{}
+	sqlStmnt, err := db.PrepareContext(ctx, "SELECT * FROM "+table+" WHERE "+where)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer sqlStmnt.Close()
+	rows, err := sqlStmnt.QueryContext(ctx, vals...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, dbError(err)
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, dbError(err)
+	}
+	for rows.Next() {
+		colVals := make([]interface{}, len(cols))
+		dest := make([]interface{}, len(cols))
+		for c := range colVals {
+			dest[c] = &colVals[c]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, dbError(err)
+		}
+		snapshot := map[string]interface{}{}
+		for c, col := range cols {
+			switch v := colVals[c].(type) {
+			case []byte:
+				snapshot[strings.ToLower(col)] = auditBytes(colTypes[c].DatabaseTypeName(), v)
+			case time.Time:
+				snapshot[strings.ToLower(col)] = v.UTC().Format(time.RFC3339Nano)
+			default:
+				snapshot[strings.ToLower(col)] = v
+			}
+		}
+		for _, col := range unauditedColumns[table] {
+			delete(snapshot, col)
+		}
+		id, _ := strconv.Atoi(fmt.Sprint(snapshot["id"]))
+		snapshots[id] = snapshot
+	}
+	return snapshots, dbError(rows.Err())
+}
+
+// auditBytes returns the audited value of a column of dbType, which is its length and checksum for binary columns
+func auditBytes(dbType string, v []byte) string {
+	if strings.Contains(dbType, "BLOB") || strings.Contains(dbType, "BINARY") {
+		sum := sha256.Sum256(v)
+		return fmt.Sprintf("%v bytes sha256 %s", len(v), hex.EncodeToString(sum[:]))
+	}
+	return string(v)
+}
+
+// writeAudits audits the changed columns of each row, with the DBTx Actor or otherwise the user, org and role of the row
+func writeAudits(ctx context.Context, db dbExecutor, action string, table string, before map[int]map[string]interface{}, after map[int]map[string]interface{}) error {
+	var txActor Actor
+	if t, ok := db.(*DBTx); ok {
+		txActor = t.Actor
+	}
+	var ids []int
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		oldValues, newValues := before[id], after[id]
+		rowAction := action
+		switch {
+		case oldValues == nil:
+			rowAction = tukcnst.INSERT
+		case newValues == nil:
+			rowAction = tukcnst.DELETE
+		default:
+			oldValues, newValues = map[string]interface{}{}, map[string]interface{}{}
+			for col, val := range before[id] {
+				if fmt.Sprint(val) != fmt.Sprint(after[id][col]) {
+					oldValues[col] = val
+					newValues[col] = after[id][col]
+				}
+			}
+			if len(newValues) == 0 {
+				continue
+			}
+		}
+		row := before[id]
+		if after[id] != nil {
+			row = after[id]
+		}
+		nhsid, _ := row["nhsid"].(string)
+		actor := txActor
+		if actor == (Actor{}) {
+			actor.User, _ = row["user"].(string)
+			actor.Org, _ = row["org"].(string)
+			actor.Role, _ = row["role"].(string)
+		}
+		if actor.User == "" {
+			return dbError(newDBError(ErrValidation, "audited change to %s id %v has no actor, use WithTxContext and ContextWithActor", table, id))
+		}
+		oldStr, newStr := "", ""
+		if oldValues != nil {
+			js, _ := json.Marshal(oldValues)
+			oldStr = string(js)
+		}
+		if newValues != nil {
+			js, _ := json.Marshal(newValues)
+			newStr = string(js)
+		}
+		if _, err := execStmnt(ctx, db, "INSERT INTO "+tukcnst.AUDITS+" (user, org, role, action, tablename, rowid, nhsid, oldvalues, newvalues) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", actor.User, actor.Org, actor.Role, rowAction, table, id, nhsid, oldStr, newStr); err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
+}
+
+// PullPoints
+// SelectPullPoints returns the pull points matching filter, see SelectSubscriptions
+func SelectPullPoints(filter PullPoint) ([]PullPoint, error) {
+	return selectRows(DBConn, tukcnst.PULLPOINTS, filter)
+}
+
+// SelectPullPointMessages returns the pull point messages matching filter, see SelectSubscriptions
+func SelectPullPointMessages(filter PullPointMessage) ([]PullPointMessage, error) {
+	return selectRows(DBConn, PULLPOINT_MESSAGES, filter)
+}
+
+// CreatePullPoint creates a pull point for the consumer endpoint, whose messages expire after expiry (0 never expires). An ErrConflict error is returned if the endpoint already has a pull point
+func CreatePullPoint(endpoint string, expiry time.Duration) (PullPoint, error) {
+	return createPullPoint(DBConn, endpoint, expiry)
+}
+func createPullPoint(db dbExecutor, endpoint string, expiry time.Duration) (PullPoint, error) {
+	if endpoint == "" {
+		return PullPoint{}, dbError(newDBError(ErrValidation, "pull point requires an endpoint"))
+	}
+	pullpoint := PullPoint{Endpoint: endpoint, Expiry: int(expiry.Seconds())}
+	pullpoints := PullPoints{Action: tukcnst.INSERT}
+	pullpoints.PullPoints = append(pullpoints.PullPoints, pullpoint)
+	if err := pullpoints.execute(db); err != nil {
+		return PullPoint{}, err
+	}
+	return getPullPoint(db, endpoint)
+}
+
+// GetPullPoint returns the pull point of the consumer endpoint, or an ErrNotFound error
+func GetPullPoint(endpoint string) (PullPoint, error) {
+	return getPullPoint(DBConn, endpoint)
+}
+func getPullPoint(db dbExecutor, endpoint string) (PullPoint, error) {
+	pullpoints, err := selectRows(db, tukcnst.PULLPOINTS, PullPoint{Endpoint: endpoint})
+	if err != nil {
+		return PullPoint{}, err
+	}
+	if len(pullpoints) == 0 {
+		return PullPoint{}, dbError(newDBError(ErrNotFound, "no pull point found for endpoint %s", endpoint))
+	}
+	return pullpoints[0], nil
+}
+
+// DestroyPullPoint deletes pull point id and all of its messages
+func DestroyPullPoint(id int) error {
+	return WithTx(nil, func(tx *DBTx) error {
+		return tx.DestroyPullPoint(id)
+	})
+}
+func destroyPullPoint(db dbExecutor, id int) error {
+	if id < 1 {
+		return dbError(newDBError(ErrValidation, "pull point requires an id"))
+	}
+	msgs := PullPointMessages{Action: tukcnst.DELETE}
+	msgs.PullPointMessages = append(msgs.PullPointMessages, PullPointMessage{PullPointId: id})
+	if err := msgs.execute(db); err != nil {
+		return err
+	}
+	pullpoints := PullPoints{Action: tukcnst.DELETE}
+	pullpoints.PullPoints = append(pullpoints.PullPoints, PullPoint{Id: id})
+	return pullpoints.execute(db)
+}
+
+// EnqueuePullPointMessage adds message to pull point id, setting its expiry from the pull point, and returns the message id
+func EnqueuePullPointMessage(id int, message string) (int, error) {
+	return enqueuePullPointMessage(DBConn, id, message)
+}
+func enqueuePullPointMessage(db dbExecutor, id int, message string) (int, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	sqlrslt, err := execStmnt(ctx, db, "INSERT INTO "+PULLPOINT_MESSAGES+" (pullpointid, message, expires) SELECT id, ?, IF(expiry > 0, UTC_TIMESTAMP() + INTERVAL expiry SECOND, NULL) FROM "+tukcnst.PULLPOINTS+" WHERE id = ?", message, id)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	if cnt, err := sqlrslt.RowsAffected(); err != nil || cnt == 0 {
+		if err == nil {
+			err = newDBError(ErrNotFound, "no pull point found for id %v", id)
+		}
+		return 0, dbError(err)
+	}
+	msgid, err := sqlrslt.LastInsertId()
+	return int(msgid), dbError(err)
+}
+
+// GetPullPointMessages returns up to n of the oldest unacknowledged and unexpired messages of pull point id. The messages are not consumed, they are returned again until acknowledged or deleted
+func GetPullPointMessages(id int, n int) ([]PullPointMessage, error) {
+	return getPullPointMessages(DBConn, id, n)
+}
+func getPullPointMessages(db dbExecutor, id int, n int) ([]PullPointMessage, error) {
+	return queryStructs[PullPointMessage](db, "SELECT * FROM "+PULLPOINT_MESSAGES+" WHERE pullpointid = ? AND acked IS NULL AND (expires IS NULL OR expires > UTC_TIMESTAMP()) ORDER BY id LIMIT ?", id, n)
+}
+
+// AckPullPointMessages acknowledges the messages msgids of pull point id so they are no longer returned by GetPullPointMessages. It returns the number of messages acknowledged
+func AckPullPointMessages(id int, msgids ...int) (int, error) {
+	return ackPullPointMessages(DBConn, id, msgids...)
+}
+func ackPullPointMessages(db dbExecutor, id int, msgids ...int) (int, error) {
+	return execPullPointMessages(db, "UPDATE "+PULLPOINT_MESSAGES+" SET acked = UTC_TIMESTAMP() WHERE", "acked IS NULL AND pullpointid = ?", id, msgids)
+}
+
+// DeletePullPointMessages deletes the messages msgids of pull point id, returning the number deleted
+func DeletePullPointMessages(id int, msgids ...int) (int, error) {
+	return deletePullPointMessages(DBConn, id, msgids...)
+}
+func deletePullPointMessages(db dbExecutor, id int, msgids ...int) (int, error) {
+	return execPullPointMessages(db, "DELETE FROM "+PULLPOINT_MESSAGES+" WHERE", "pullpointid = ?", id, msgids)
+}
+func execPullPointMessages(db dbExecutor, stmntStr string, where string, id int, msgids []int) (int, error) {
+	if len(msgids) == 0 {
+		return 0, nil
+	}
+	vals := []interface{}{id}
+	for _, msgid := range msgids {
+		vals = append(vals, msgid)
+	}
+	where = where + " AND id IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(msgids)), ", ") + ")"
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	sqlrslt, err := execStmnt(ctx, db, stmntStr+" "+where, vals...)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	cnt, err := sqlrslt.RowsAffected()
+	return int(cnt), dbError(err)
+}
+
+// PurgePullPointMessages deletes the expired and acknowledged messages of every pull point, returning the number deleted
+func PurgePullPointMessages() (int, error) {
+	return purgePullPointMessages(DBConn)
+}
+func purgePullPointMessages(db dbExecutor) (int, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelCtx()
+	sqlrslt, err := execStmnt(ctx, db, "DELETE FROM "+PULLPOINT_MESSAGES+" WHERE acked IS NOT NULL OR expires <= UTC_TIMESTAMP()")
+	if err != nil {
+		return 0, dbError(err)
+	}
+	cnt, err := sqlrslt.RowsAffected()
+	return int(cnt), dbError(err)
+}
+func (i *PullPoints) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *PullPoints) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = "SELECT * FROM " + tukcnst.PULLPOINTS
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.PullPoints) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.PULLPOINTS, reflectStruct(reflect.ValueOf(i.PullPoints[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var pullpoints []PullPoint
+		if pullpoints, err = scanRows[PullPoint](ctx, sqlStmnt, vals); err == nil {
+			i.PullPoints = append(i.PullPoints, pullpoints...)
+			i.Count = i.Count + len(pullpoints)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+func (i *PullPointMessages) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *PullPointMessages) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = "SELECT * FROM " + PULLPOINT_MESSAGES
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.PullPointMessages) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, PULLPOINT_MESSAGES, reflectStruct(reflect.ValueOf(i.PullPointMessages[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var msgs []PullPointMessage
+		if msgs, err = scanRows[PullPointMessage](ctx, sqlStmnt, vals); err == nil {
+			i.PullPointMessages = append(i.PullPointMessages, msgs...)
+			i.Count = i.Count + len(msgs)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Config
+// SelectConfigs returns the config rows matching filter, see SelectSubscriptions
+func SelectConfigs(filter Config) ([]Config, error) {
+	return selectRows(DBConn, tukcnst.CONFIG, filter)
+}
+
+// GetConfig returns the most specific config value name applying to scope, or an ErrNotFound error
+func GetConfig(scope ConfigScope, name string) (Config, error) {
+	return getConfig(DBConn, scope, name)
+}
+func getConfig(db dbExecutor, scope ConfigScope, name string) (Config, error) {
+	configs, err := getScopeConfigs(db, scope, name)
+	if err != nil {
+		return Config{}, err
+	}
+	config, ok := effectiveConfigs(configs)[name]
+	if !ok {
+		return Config{}, dbError(newDBError(ErrNotFound, "no config %s found for service %s org %s user %s", name, scope.Service, scope.Org, scope.User))
+	}
+	return config, nil
+}
+
+// GetConfigs returns the most specific value of every config name applying to scope
+func GetConfigs(scope ConfigScope) (map[string]Config, error) {
+	return getConfigs(DBConn, scope)
+}
+func getConfigs(db dbExecutor, scope ConfigScope) (map[string]Config, error) {
+	configs, err := getScopeConfigs(db, scope, "")
+	if err != nil {
+		return nil, err
+	}
+	return effectiveConfigs(configs), nil
+}
+
+// GetConfigString returns config value name applying to scope
+func GetConfigString(scope ConfigScope, name string) (string, error) {
+	config, err := GetConfig(scope, name)
+	return config.Value, err
+}
+
+// GetConfigInt returns config value name applying to scope as an int, or an ErrValidation error if it is not one
+func GetConfigInt(scope ConfigScope, name string) (int, error) {
+	config, err := GetConfig(scope, name)
+	if err != nil {
+		return 0, err
+	}
+	val, err := strconv.Atoi(strings.TrimSpace(config.Value))
+	return val, configValueError(config, err)
+}
+
+// GetConfigBool returns config value name applying to scope as a bool, see strconv.ParseBool, or an ErrValidation error if it is not one
+func GetConfigBool(scope ConfigScope, name string) (bool, error) {
+	config, err := GetConfig(scope, name)
+	if err != nil {
+		return false, err
+	}
+	val, err := strconv.ParseBool(strings.TrimSpace(config.Value))
+	return val, configValueError(config, err)
+}
+
+// GetConfigDuration returns config value name applying to scope as a duration, see time.ParseDuration, or an ErrValidation error if it is not one
+func GetConfigDuration(scope ConfigScope, name string) (time.Duration, error) {
+	config, err := GetConfig(scope, name)
+	if err != nil {
+		return 0, err
+	}
+	val, err := time.ParseDuration(strings.TrimSpace(config.Value))
+	return val, configValueError(config, err)
+}
+
+// GetConfigJSON unmarshals config value name applying to scope into v
+func GetConfigJSON(scope ConfigScope, name string, v interface{}) error {
+	config, err := GetConfig(scope, name)
+	if err != nil {
+		return err
+	}
+	return configValueError(config, json.Unmarshal([]byte(config.Value), v))
+}
+func configValueError(config Config, err error) error {
+	if err == nil {
+		return nil
+	}
+	return dbError(&DBError{Kind: ErrValidation, Err: fmt.Errorf("config %s value %s - %w", config.Name, config.Value, err)})
+}
+
+// SetConfig creates or updates config value name for scope. Strings are stored as they are, durations, ints, bools and floats in the form the typed getters read, and other values as JSON
+func SetConfig(scope ConfigScope, name string, value interface{}) error {
+	return setConfig(DBConn, scope, name, value)
+}
+func setConfig(db dbExecutor, scope ConfigScope, name string, value interface{}) error {
+	if name == "" {
+		return dbError(newDBError(ErrValidation, "config requires a name"))
+	}
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case time.Duration:
+		str = v.String()
+	case int, int64, bool, float64:
+		str = fmt.Sprint(v)
+	default:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return dbError(&DBError{Kind: ErrValidation, Err: err})
+		}
+		str = string(js)
+	}
+	if err := checkDBConn(db); err != nil {
+		return err
+	}
+	_, err := upsertParams(db, tukcnst.CONFIG, map[string]interface{}{"service": scope.Service, "org": scope.Org, "user": scope.User, "name": name, "value": str}, []string{"service", "org", "user", "name"})
+	return err
+}
+
+// DeleteConfig removes config value name set for exactly scope. Values set for other scopes are unchanged
+func DeleteConfig(scope ConfigScope, name string) error {
+	return deleteConfig(DBConn, scope, name)
+}
+func deleteConfig(db dbExecutor, scope ConfigScope, name string) error {
+	if err := checkDBConn(db); err != nil {
+		return err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	where := "service = ? AND org = ? AND user = ? AND name = ?"
+	vals := []interface{}{scope.Service, scope.Org, scope.User, name}
+	_, err := auditRows(ctx, db, tukcnst.DELETE, tukcnst.CONFIG, where, vals, func(db dbExecutor) (int, error) {
+		_, err := execStmnt(ctx, db, "DELETE FROM "+tukcnst.CONFIG+" WHERE "+where, vals...)
+		return 0, dbError(err)
+	})
+	return err
+}
+
+// getScopeConfigs returns the config rows applying to scope, for name if not empty
+func getScopeConfigs(db dbExecutor, scope ConfigScope, name string) ([]Config, error) {
+	return queryStructs[Config](db, "SELECT * FROM "+tukcnst.CONFIG+" WHERE (? = '' OR name = ?) AND (service = '' OR service = ?) AND (org = '' OR org = ?) AND (user = '' OR user = ?)", name, name, scope.Service, scope.Org, scope.User)
+}
+
+// effectiveConfigs returns the most specific of configs for each name
+func effectiveConfigs(configs []Config) map[string]Config {
+	specificity := func(c Config) int {
+		n := 0
+		if c.User != "" {
+			n = n + 4
+		}
+		if c.Org != "" {
+			n = n + 2
+		}
+		if c.Service != "" {
+			n = n + 1
+		}
+		return n
+	}
+	effective := make(map[string]Config)
+	for _, config := range configs {
+		if current, ok := effective[config.Name]; !ok || specificity(config) > specificity(current) {
+			effective[config.Name] = config
+		}
+	}
+	return effective
+}
+
+// NewConfigWatcher returns a ConfigWatcher for scope polling every interval
+func NewConfigWatcher(scope ConfigScope, interval time.Duration) *ConfigWatcher {
+	return &ConfigWatcher{Scope: scope, Interval: interval, subs: make(map[string][]func(Config)), values: make(map[string]Config)}
+}
+
+// Subscribe registers fn to be called with the new value when config value name changes, including when it is first read by Run. When the value is removed fn is called with a Config with only the Name set
+func (w *ConfigWatcher) Subscribe(name string, fn func(Config)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.subs == nil {
+		w.subs = make(map[string][]func(Config))
+	}
+	w.subs[name] = append(w.subs[name], fn)
+}
+
+// Run polls for config changes until ctx is cancelled, returning ctx.Err(). Polling errors are logged and retried at the next interval
+func (w *ConfigWatcher) Run(ctx context.Context) error {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(); err != nil {
+			log.Println(err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+func (w *ConfigWatcher) poll() error {
+	configs, err := GetConfigs(w.Scope)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	var notify []func()
+	for name, config := range configs {
+		if current, ok := w.values[name]; !ok || current.Id != config.Id || current.Value != config.Value {
+			for _, fn := range w.subs[name] {
+				fn, config := fn, config
+				notify = append(notify, func() { fn(config) })
+			}
+		}
+	}
+	for name := range w.values {
+		if _, ok := configs[name]; !ok {
+			for _, fn := range w.subs[name] {
+				fn, name := fn, name
+				notify = append(notify, func() { fn(Config{Name: name}) })
+			}
+		}
+	}
+	w.values = configs
+	w.mu.Unlock()
+	for _, fn := range notify {
+		fn()
+	}
+	return nil
+}
+func (i *Configs) newEvent() error {
+	return i.execute(DBConn)
+}
+func (i *Configs) execute(db dbExecutor) error {
+	var err error
+	if err = checkDBConn(db); err != nil {
+		return err
+	}
+	var stmntStr = "SELECT * FROM " + tukcnst.CONFIG
+	var vals []interface{}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if len(i.Configs) > 0 {
+		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.CONFIG, reflectStruct(reflect.ValueOf(i.Configs[0]))); err != nil {
+			return dbError(err)
+		}
+	}
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return dbError(err)
+	}
+	defer sqlStmnt.Close()
+
+	if i.Action == tukcnst.SELECT {
+		var configs []Config
+		if configs, err = scanRows[Config](ctx, sqlStmnt, vals); err == nil {
+			i.Configs = append(i.Configs, configs...)
+			i.Count = i.Count + len(configs)
+		}
+	} else {
+		i.LastInsertId, err = auditedLastID(ctx, db, i.Action, stmntStr, sqlStmnt, vals)
+	}
+	return err
+}
+
+// Migrations
+// GetMigrations returns the embedded schema migrations in version order. Migration files are named <version>_<name>.up.sql and <version>_<name>.down.sql
+func GetMigrations() ([]Migration, error) {
+	return readMigrations(migrationFS)
+}
+func readMigrations(fsys fs.FS) ([]Migration, error) {
+	var migrations []Migration
+	files, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return migrations, dbError(err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		var direction string
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		verStr, migName, _ := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		ver, err := strconv.Atoi(verStr)
+		if err != nil {
+			err = newDBError(ErrValidation, "invalid migration file name %s", name)
+			return migrations, dbError(err)
+		}
+		content, err := fs.ReadFile(fsys, "migrations/"+name)
+		if err != nil {
+			return migrations, dbError(err)
+		}
+		m, ok := byVersion[ver]
+		if !ok {
+			m = &Migration{Version: ver, Name: migName}
+			byVersion[ver] = m
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies all pending embedded migrations
+func Migrate() error {
+	migrations, err := GetMigrations()
+	if err != nil || len(migrations) == 0 {
+		return err
+	}
+	return MigrateTo(migrations[len(migrations)-1].Version)
+}
+
+// MigrateTo applies up migrations to version and reverts those above it, holding a mysql advisory lock
+func MigrateTo(version int) error {
+	migrations, err := GetMigrations()
+	if err != nil {
+		return err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancelCtx()
+	if err = checkDBConn(DBConn); err != nil {
+		return err
+	}
+	conn, err := DBConn.Conn(ctx)
+	if err != nil {
+		return dbError(err)
+	}
+	defer conn.Close()
+	defer func() {
+		auditTable.Lock()
+		auditTable.checked = false
+		auditTable.Unlock()
+	}()
+
+	locked := 0
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK('tukdbint_schema_migrations', 60)").Scan(&locked); err != nil {
+		return dbError(err)
+	}
+	if locked != 1 {
+		err = newDBError(ErrTimeout, "timed out waiting for schema migrations lock")
+		return dbError(err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('tukdbint_schema_migrations')")
+
+	if _, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+		return dbError(err)
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > version || applied[m.Version] {
+			continue
+		}
+		log.Printf("Applying schema migration %v %s", m.Version, m.Name)
+		if err = execMigration(ctx, conn, m.Up); err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+			return dbError(err)
+		}
+	}
+	for r := len(migrations) - 1; r >= 0; r-- {
+		m := migrations[r]
+		if m.Version <= version || !applied[m.Version] {
+			continue
+		}
+		log.Printf("Reverting schema migration %v %s", m.Version, m.Name)
+		if err = execMigration(ctx, conn, m.Down); err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.Version); err != nil {
+			return dbError(err)
+		}
+	}
+	log.Printf("Database schema is at version %v", version)
+	return nil
+}
+
+// GetSchemaVersion returns the highest applied migration version, or 0 if no migrations have been applied
+func GetSchemaVersion() (int, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	var version sql.NullInt64
+	if err := checkDBConn(DBConn); err != nil {
+		return 0, err
+	}
+	if err := DBConn.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, dbError(err)
+	}
+	return int(version.Int64), nil
+}
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	applied := make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return applied, dbError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ver int
+		if err = rows.Scan(&ver); err != nil {
+			return applied, dbError(err)
+		}
+		applied[ver] = true
+	}
+	return applied, rows.Err()
+}
+
+// execMigration runs stmnts, ignoring duplicate or missing index errors so a failed migration can be rerun
+func execMigration(ctx context.Context, conn *sql.Conn, stmnts string) error {
+	for _, stmnt := range strings.Split(stmnts, ";") {
+		if stmnt = strings.TrimSpace(stmnt); stmnt == "" {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, stmnt); err != nil {
+			if isIndexStateError(err) {
+				log.Printf("Ignoring %s", err.Error())
+				continue
+			}
+			return dbError(err)
+		}
+	}
+	return nil
+}
+
+// isIndexStateError reports whether err is a mysql duplicate key name (1061) or missing key (1091) error
+func isIndexStateError(err error) bool {
+	var myerr *mysql.MySQLError
+	if errors.As(err, &myerr) {
+		return myerr.Number == 1061 || myerr.Number == 1091
+	}
+	return false
+}
+
+// Schema Validation
+// ValidateSchema reports the differences between the tables and their structs, returning an error if strict
+func ValidateSchema(strict bool) (SchemaReport, error) {
+	report := SchemaReport{}
+	type schemaColumn struct {
+		TableName  string `db:"table_name"`
+		ColumnName string `db:"column_name"`
+		DataType   string `db:"data_type"`
+	}
+	cols, err := Query[schemaColumn]("SELECT TABLE_NAME AS table_name, COLUMN_NAME AS column_name, DATA_TYPE AS data_type FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() ORDER BY TABLE_NAME, ORDINAL_POSITION")
+	if err != nil {
+		return report, err
+	}
+	dbTables := make(map[string]map[string]string)
+	for _, col := range cols {
+		if _, ok := dbTables[col.TableName]; !ok {
+			dbTables[col.TableName] = make(map[string]string)
+		}
+		dbTables[col.TableName][strings.ToLower(col.ColumnName)] = strings.ToLower(col.DataType)
+	}
+	var tables []string
+	for table := range schemaStructs {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		dbCols, ok := dbTables[table]
+		if !ok {
+			report.Mismatches = append(report.Mismatches, SchemaMismatch{Table: table, Problem: "table does not exist"})
+			continue
+		}
+		fields := structFields(schemaStructs[table])
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := fields[name]
+			dataType, ok := dbCols[name]
+			if !ok {
+				report.Mismatches = append(report.Mismatches, SchemaMismatch{Table: table, Column: name, Field: field.Name, Problem: "column does not exist"})
+				continue
+			}
+			if !compatibleColumnType(field.Type, dataType) {
+				report.Mismatches = append(report.Mismatches, SchemaMismatch{Table: table, Column: name, Field: field.Name, Problem: fmt.Sprintf("column type %s cannot be scanned into %s", dataType, field.Type)})
+			}
+		}
+		var colNames []string
+		for col := range dbCols {
+			colNames = append(colNames, col)
+		}
+		sort.Strings(colNames)
+		for _, col := range colNames {
+			if _, ok := fields[col]; !ok {
+				report.Mismatches = append(report.Mismatches, SchemaMismatch{Table: table, Column: col, Problem: "column has no struct field"})
+			}
+		}
+	}
+	if len(report.Mismatches) == 0 {
+		log.Println("Database schema matches")
+		return report, nil
+	}
+	log.Println(report.String())
+	if strict {
+		err = newDBError(ErrValidation, "database schema does not match - %v mismatches", len(report.Mismatches))
+	}
+	return report, err
+}
+func (r SchemaReport) String() string {
+	if len(r.Mismatches) == 0 {
+		return "Database schema matches"
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Database schema has %v mismatches", len(r.Mismatches)))
+	for _, m := range r.Mismatches {
+		b.WriteString("\n  " + m.Table)
+		if m.Column != "" {
+			b.WriteString("." + m.Column)
+		}
+		if m.Field != "" {
+			b.WriteString(" (" + m.Field + ")")
+		}
+		b.WriteString(" - " + m.Problem)
+	}
+	return b.String()
+}
+
+// structFields returns the persisted fields of t keyed on column name, the lower cased field name or `db` struct tag
+func structFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for f := 0; f < t.NumField(); f++ {
+		field := t.Field(f)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.ToLower(field.Name)
+		if tag := field.Tag.Get("db"); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = strings.ToLower(tag)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+func compatibleColumnType(t reflect.Type, dataType string) bool {
+	switch t.Kind() {
+	case reflect.String:
+		switch dataType {
+		case "char", "varchar", "tinytext", "text", "mediumtext", "longtext", "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "enum", "set", "json", "date", "datetime", "timestamp", "time", "decimal":
+			return true
+		}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		switch dataType {
+		case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+			return true
+		}
+	case reflect.Bool:
+		switch dataType {
+		case "tinyint", "bit", "bool", "boolean":
+			return true
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			switch dataType {
+			case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+				return true
+			}
+		}
+	case reflect.Struct:
+		if t == reflect.TypeOf(DBTime{}) || t == reflect.TypeOf(time.Time{}) {
+			switch dataType {
+			case "date", "datetime", "timestamp":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Batch Inserts
+// InsertBatch inserts the envelope rows in one transaction and returns their ids in order, see insertBatch
+func InsertBatch(i DBBatchInterface) ([]int, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), txTimeout)
+	defer cancelCtx()
+	return InsertBatchContext(ctx, i)
+}
+
+// InsertBatchContext is InsertBatch with the transaction bound to ctx instead of the default deadline. The Actor of ctx is recorded in the audit trail, see ContextWithActor
+func InsertBatchContext(ctx context.Context, i DBBatchInterface) ([]int, error) {
+	table, rows := i.batchParams()
+	var ids []int
+	err := WithTxContext(ctx, nil, func(tx *DBTx) error {
+		var err error
+		ids, err = insertBatch(tx.ctx, tx, table, rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Inserted %v rows into %s", len(ids), table)
+	return ids, nil
+}
+func (i *Subscriptions) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Subscriptions {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.SUBSCRIPTIONS, rows
+}
+func (i *Events) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Events {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.EVENTS, rows
+}
+func (i *Workflows) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Workflows {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.WORKFLOWS, rows
+}
+func (i *WorkflowStates) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Workflowstate {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return WORKFLOWSTATE, rows
+}
+func (i *XDWS) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.XDW {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.XDWS, rows
+}
+func (i *Templates) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Templates {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.TEMPLATES, rows
+}
+func (i *IdMaps) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.LidMap {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.ID_MAPS, rows
+}
+func (i *EventAcks) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.EventAcks {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.EVENT_ACKS, rows
+}
+func (i *ServiceStates) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.ServiceStates {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.SERVICE_STATES, rows
+}
+func (i *PullPoints) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.PullPoints {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.PULLPOINTS, rows
+}
+func (i *PullPointMessages) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.PullPointMessages {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return PULLPOINT_MESSAGES, rows
+}
+func (i *Configs) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Configs {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.CONFIG, rows
+}
+func (i *Statics) batchParams() (string, []map[string]interface{}) {
+	var rows []map[string]interface{}
+	for _, v := range i.Static {
+		rows = append(rows, reflectStruct(reflect.ValueOf(v)))
+	}
+	return tukcnst.STATICS, rows
+}
+
+// insertBatch inserts rows as multi-row INSERTs, deriving each id from the first id of its statement and auto_increment_increment
+func insertBatch(ctx context.Context, db dbExecutor, table string, rows []map[string]interface{}) ([]int, error) {
+	var ids []int
+	increments, err := queryStructsContext[struct{ Increment int }](ctx, db, "SELECT @@SESSION.auto_increment_increment AS increment")
+	if err != nil {
+		return ids, err
+	}
+	step := 1
+	if len(increments) > 0 && increments[0].Increment > 0 {
+		step = increments[0].Increment
+	}
+	for start := 0; start < len(rows); {
+		cols := batchColumns(rows[start])
+		end := start + 1
+		for end < len(rows) && end-start < maxBatchRows && (end-start+1)*len(cols) <= maxBatchParams && sameColumns(cols, rows[end]) {
+			end++
+		}
+		stmntStr, vals := createBatchStmnt(table, cols, rows[start:end])
+		sqlrslt, err := execStmnt(ctx, db, stmntStr, vals...)
+		if err != nil {
+			return ids, dbError(err)
+		}
+		id, err := sqlrslt.LastInsertId()
+		if err != nil {
+			return ids, dbError(err)
+		}
+		var batchIds []int
+		for n := 0; n < end-start; n++ {
+			batchIds = append(batchIds, int(id)+n*step)
+		}
+		if err = auditIds(ctx, db, table, batchIds); err != nil {
+			return ids, err
 		}
-	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+		ids = append(ids, batchIds...)
+		start = end
 	}
-	return err
+	return ids, nil
 }
-
-// XDWs
-func GetPathways(user string) map[string]string {
-	var names = make(map[string]string)
-	xdws := XDWS{Action: tukcnst.SELECT}
-	xdw := XDW{IsXDSMeta: false}
-	xdws.XDW = append(xdws.XDW, xdw)
-	if err := xdws.newEvent(); err == nil {
-		for _, xdw := range xdws.XDW {
-			if xdw.Id > 0 {
-				names[xdw.Name] = strings.TrimSpace(GetIDMapsMappedId(user, xdw.Name))
-			}
-		}
+func batchColumns(params map[string]interface{}) []string {
+	var cols []string
+	for param := range params {
+		cols = append(cols, param)
 	}
-	log.Printf("%v Pathways Defined - %v", len(names), names)
-	return names
+	sort.Strings(cols)
+	return cols
 }
-func GetWorkflowDefinition(name string) (XDW, error) {
-	var err error
-	xdws := XDWS{Action: tukcnst.SELECT}
-	xdw := XDW{Name: name}
-	xdws.XDW = append(xdws.XDW, xdw)
-	if err = xdws.newEvent(); err == nil {
-		if xdws.Count == 1 {
-			return xdws.XDW[1], nil
-		} else {
-			return xdw, errors.New("no xdw registered for " + name)
+func sameColumns(cols []string, params map[string]interface{}) bool {
+	if len(cols) != len(params) {
+		return false
+	}
+	for _, col := range cols {
+		if _, ok := params[col]; !ok {
+			return false
 		}
 	}
-	return xdw, err
+	return true
 }
-func GetWorkflowXDSMeta(name string) (string, error) {
-	var err error
-	xdws := XDWS{Action: tukcnst.SELECT}
-	xdw := XDW{Name: name, IsXDSMeta: true}
-	xdws.XDW = append(xdws.XDW, xdw)
-	if err = xdws.newEvent(); err == nil {
-		if xdws.Count == 1 {
-			return xdws.XDW[1].XDW, nil
+func createBatchStmnt(table string, cols []string, rows []map[string]interface{}) (string, []interface{}) {
+	var vals []interface{}
+	qStr := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ") + ")"
+	rowStrs := make([]string, len(rows))
+	for r, row := range rows {
+		for _, col := range cols {
+			vals = append(vals, row[col])
 		}
+		rowStrs[r] = qStr
 	}
-	return "", errors.New("no xdw meta registered for " + name)
+	stmntStr := "INSERT INTO " + table + " (" + strings.Join(cols, ", ") + ") VALUES " + strings.Join(rowStrs, ", ")
+	log.Printf("Created Batch Statement for %v rows %s", len(rows), stmntStr[:strings.Index(stmntStr, " VALUES ")])
+	return stmntStr, vals
 }
 
-func PersistWorkflowDefinition(name string, config string, isxdsmeta bool) error {
-	xdws := XDWS{Action: tukcnst.DELETE}
-	xdw := XDW{Name: name, IsXDSMeta: isxdsmeta}
-	xdws.XDW = append(xdws.XDW, xdw)
-	xdws.newEvent()
-	xdws = XDWS{Action: tukcnst.INSERT}
-	xdw = XDW{Name: name, IsXDSMeta: isxdsmeta, XDW: config}
-	xdws.XDW = append(xdws.XDW, xdw)
-	return xdws.newEvent()
+// Raw Queries
+// Query runs stmntStr and scans each row into a new T, matching columns to lower cased field names or `db` tags
+func Query[T any](stmntStr string, vals ...interface{}) ([]T, error) {
+	return queryStructs[T](DBConn, stmntStr, vals...)
 }
-func (i *XDWS) newEvent() error {
-	var err error
-	var stmntStr = tukcnst.SQL_DEFAULT_XDWS
-	var rows *sql.Rows
-	var vals []interface{}
-	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+
+// lockRows runs stmntStr with FOR UPDATE appended, see lockStmnt
+func lockRows[T any](t *DBTx, timeout time.Duration, stmntStr string, vals ...interface{}) ([]T, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout+2*time.Second)
 	defer cancelCtx()
-	if len(i.XDW) > 0 {
-		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.XDWS, reflectStruct(reflect.ValueOf(i.XDW[0]))); err != nil {
-			log.Println(err.Error())
-			return err
-		}
+	return queryStructsContext[T](ctx, t.tx, lockStmnt(stmntStr, timeout), vals...)
+}
+
+// lockStmnt returns the SELECT stmntStr locking its rows. A timeout of 0 uses NOWAIT, otherwise innodb_lock_wait_timeout is set to timeout (minimum 1 second) for the statement only, with a SET_VAR hint
+func lockStmnt(stmntStr string, timeout time.Duration) string {
+	if timeout == 0 {
+		return stmntStr + " FOR UPDATE NOWAIT"
 	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
-	if err != nil {
-		log.Println(err.Error())
-		return err
+	secs := int(timeout.Seconds())
+	if secs < 1 {
+		secs = 1
 	}
-	defer sqlStmnt.Close()
+	return strings.Replace(stmntStr, "SELECT ", fmt.Sprintf("SELECT /*+ SET_VAR(innodb_lock_wait_timeout=%v) */ ", secs), 1) + " FOR UPDATE"
+}
 
-	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-		}
-		for rows.Next() {
-			xdw := XDW{}
-			if err := rows.Scan(&xdw.Id, &xdw.Name, &xdw.IsXDSMeta, &xdw.XDW); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
-			}
-			i.XDW = append(i.XDW, xdw)
-			i.Count = i.Count + 1
-		}
-	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+// isDuplicateKeyError reports whether err is a mysql duplicate unique key error (1062)
+func isDuplicateKeyError(err error) bool {
+	var myerr *mysql.MySQLError
+	if errors.As(err, &myerr) {
+		return myerr.Number == 1062
 	}
-	return err
+	return false
 }
 
-// Workflowstates
-func (i *WorkflowStates) newEvent() error {
-	var err error
-	var stmntStr = "SELECT * FROM workflowstate"
-	var rows *sql.Rows
-	var vals []interface{}
-	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancelCtx()
-	if len(i.Workflowstate) > 0 {
-		if stmntStr, vals, err = createPreparedStmnt(i.Action, "workflowstate", reflectStruct(reflect.ValueOf(i.Workflowstate[0]))); err != nil {
-			log.Println(err.Error())
-			return err
-		}
-	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
-	if err != nil {
-		log.Println(err.Error())
-		return err
+// isDeadlockError reports whether err is, or wraps, a mysql deadlock (1213), after which mysql has rolled back the transaction
+func isDeadlockError(err error) bool {
+	var myerr *mysql.MySQLError
+	if errors.As(err, &myerr) {
+		return myerr.Number == 1213
 	}
-	defer sqlStmnt.Close()
+	return false
+}
 
-	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-		}
-		for rows.Next() {
-			workflow := Workflowstate{}
-			if err := rows.Scan(&workflow.Id, &workflow.WorkflowId, &workflow.Pathway, &workflow.NHSId, &workflow.Version, &workflow.Published, &workflow.Created, &workflow.CreatedBy, &workflow.Status, &workflow.CompleteBy, &workflow.LastUpdate, &workflow.Owner, &workflow.Overdue, &workflow.Escalated, &workflow.TargetMet, &workflow.InProgress, &workflow.Duration, &workflow.TimeRemaining); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
-			}
-			i.Workflowstate = append(i.Workflowstate, workflow)
-			i.Count = i.Count + 1
-		}
-	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+// isLockError reports whether err is a mysql lock wait timeout (1205) or NOWAIT lock failure (3572)
+func isLockError(err error) bool {
+	var myerr *mysql.MySQLError
+	if errors.As(err, &myerr) {
+		return myerr.Number == 1205 || myerr.Number == 3572
 	}
-	return err
+	return false
 }
 
-// Templates
-func PersistTemplate(user string, templatename string, templatestr string) error {
-	tmplts := Templates{Action: tukcnst.DELETE}
-	tmplt := Template{Name: templatename, User: user}
-	tmplts.Templates = append(tmplts.Templates, tmplt)
-	tmplts.newEvent()
-	tmplts = Templates{Action: tukcnst.INSERT}
-	tmplt = Template{Name: templatename, Template: templatestr}
-	tmplts.Templates = append(tmplts.Templates, tmplt)
-	return tmplts.newEvent()
+// QueryTx is the transaction bound equivalent of Query
+func QueryTx[T any](tx *DBTx, stmntStr string, vals ...interface{}) ([]T, error) {
+	return queryStructs[T](tx.tx, stmntStr, vals...)
 }
-func (i *Templates) newEvent() error {
-	var err error
-	var stmntStr = tukcnst.SQL_DEFAULT_TEMPLATES
-	var rows *sql.Rows
-	var vals []interface{}
+func queryStructs[T any](db dbExecutor, stmntStr string, vals ...interface{}) ([]T, error) {
 	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancelCtx()
-	if len(i.Templates) > 0 {
-		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.TEMPLATES, reflectStruct(reflect.ValueOf(i.Templates[0]))); err != nil {
-			log.Println(err.Error())
-			return err
-		}
+	return queryStructsContext[T](ctx, db, stmntStr, vals...)
+}
+func queryStructsContext[T any](ctx context.Context, db dbExecutor, stmntStr string, vals ...interface{}) ([]T, error) {
+	var err error
+	var results []T
+	if err = checkDBConn(db); err != nil {
+		return results, err
 	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
+	log.Printf("Created Prepared Statement %s - Values %s", stmntStr, vals)
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		return results, dbError(err)
 	}
 	defer sqlStmnt.Close()
-
-	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-		}
-		for rows.Next() {
-			tmplt := Template{}
-			if err := rows.Scan(&tmplt.Id, &tmplt.Name, &tmplt.Template, &tmplt.User); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
-			}
-			i.Templates = append(i.Templates, tmplt)
-			i.Count = i.Count + 1
-		}
-	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
-	}
-	return err
+	return scanRows[T](ctx, sqlStmnt, vals)
 }
 
-// Idmaps
-func GetIDMapsMappedId(user string, localid string) string {
-	if user == "" {
-		user = "system"
+// scanRows queries the prepared sqlStmnt and scans each row into a new T by column name
+func scanRows[T any](ctx context.Context, sqlStmnt *sql.Stmt, vals []interface{}) ([]T, error) {
+	var results []T
+	if reflect.TypeOf((*T)(nil)).Elem().Kind() != reflect.Struct {
+		return results, dbError(newDBError(ErrValidation, "query result type must be a struct"))
 	}
-	duration := time.Duration(1) * time.Minute
-	expires := cached.Add(duration)
-	if len(cachedIDMaps) == 0 || time.Now().After(expires) {
-		idmaps := IdMaps{Action: tukcnst.SELECT}
-		if err := idmaps.newEvent(); err != nil {
-			log.Println(err.Error())
-		}
-		cachedIDMaps = idmaps.LidMap
-		cached = time.Now()
+	rows, err := setRows(ctx, sqlStmnt, vals)
+	if err != nil {
+		return results, dbError(err)
 	}
-	for _, v := range cachedIDMaps {
-		if v.User == user && v.Lid == localid {
-			return v.Mid
-		}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return results, dbError(err)
 	}
-	if user != "system" {
-		user = "system"
-		for _, v := range cachedIDMaps {
-			if v.User == user && v.Lid == localid {
-				return v.Mid
-			}
+	for rows.Next() {
+		var result T
+		if err = scanStruct(rows, cols, reflect.ValueOf(&result).Elem()); err != nil {
+			return results, dbError(err)
 		}
+		results = append(results, result)
 	}
-	return localid
+	return results, dbError(rows.Err())
 }
-func GetIDMapsLocalId(user string, mid string) string {
-	if user == "" {
-		user = "system"
-	}
-	idmaps := IdMaps{Action: tukcnst.SELECT}
-	idmap := IdMap{User: user}
-	idmaps.LidMap = append(idmaps.LidMap, idmap)
-	if err := idmaps.newEvent(); err != nil {
-		log.Println(err.Error())
-	}
-	for _, idmap := range idmaps.LidMap {
-		if idmap.Mid == mid && idmap.User == user {
-			return idmap.Lid
-		}
-	}
-	return mid
+
+// selectRows returns the rows of table matching the non zero fields of filter, as reflected for the envelope SELECT action
+func selectRows[T any](db dbExecutor, table string, filter T) ([]T, error) {
+	return selectFilter[T](db, table, filter)
 }
-func (i *IdMaps) newEvent() error {
-	var err error
-	var stmntStr = tukcnst.SQL_DEFAULT_IDMAPS
-	var rows *sql.Rows
-	var vals []interface{}
-	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancelCtx()
-	if len(i.LidMap) > 0 {
-		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.ID_MAPS, reflectStruct(reflect.ValueOf(i.LidMap[0]))); err != nil {
-			log.Println(err.Error())
-			return err
-		}
-	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
+
+// selectFilter returns the rows of table matching filter, which may be an entity or a filter struct with pointer fields, see reflectStruct
+func selectFilter[T any](db dbExecutor, table string, filter interface{}) ([]T, error) {
+	stmntStr, vals, err := createPreparedStmnt(tukcnst.SELECT, table, reflectStruct(reflect.ValueOf(filter)))
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		return nil, dbError(err)
 	}
-	defer sqlStmnt.Close()
+	return queryStructs[T](db, stmntStr, vals...)
+}
+func scanStruct(rows *sql.Rows, cols []string, i reflect.Value) error {
+	return rows.Scan(scanDest(cols, i)...)
+}
 
-	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-		}
-		for rows.Next() {
-			idmap := IdMap{}
-			if err := rows.Scan(&idmap.Id, &idmap.Lid, &idmap.Mid, &idmap.User); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
+// scanDest returns the scan destinations of cols in struct i. A field that is not a sql.Scanner is wrapped in a nullField, and a column with no field is discarded
+func scanDest(cols []string, i reflect.Value) []interface{} {
+	fields := reflectFields(i)
+	dest := make([]interface{}, len(cols))
+	for c, col := range cols {
+		if field, ok := fields[strings.ToLower(col)]; ok {
+			if scanner, ok := field.Addr().Interface().(sql.Scanner); ok {
+				dest[c] = scanner
+			} else {
+				dest[c] = nullField{field: field}
 			}
-			i.LidMap = append(i.LidMap, idmap)
-			i.Cnt = i.Cnt + 1
+		} else {
+			dest[c] = new(sql.RawBytes)
 		}
-	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
 	}
-	return err
+	return dest
 }
 
-// Statics
-func (i *Statics) newEvent() error {
-	var err error
-	var stmntStr = tukcnst.SQL_DEFAULT_STATICS
-	var rows *sql.Rows
-	var vals []interface{}
-	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancelCtx()
-	if len(i.Static) > 0 {
-		if stmntStr, vals, err = createPreparedStmnt(i.Action, tukcnst.STATICS, reflectStruct(reflect.ValueOf(i.Static[0]))); err != nil {
-			log.Println(err.Error())
+// nullField scans a column into a plain struct field, setting the field to its zero value when the column is NULL
+type nullField struct {
+	field reflect.Value
+}
+
+func (n nullField) Scan(src interface{}) error {
+	if src == nil {
+		n.field.Set(reflect.Zero(n.field.Type()))
+		return nil
+	}
+	switch n.field.Kind() {
+	case reflect.String:
+		var ns sql.NullString
+		if err := ns.Scan(src); err != nil {
 			return err
 		}
-	}
-	sqlStmnt, err := DBConn.PrepareContext(ctx, stmntStr)
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-	defer sqlStmnt.Close()
-
-	if i.Action == tukcnst.SELECT {
-		rows, err = setRows(ctx, sqlStmnt, vals)
-		if err != nil {
-			log.Println(err.Error())
+		n.field.SetString(ns.String)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var ni sql.NullInt64
+		if err := ni.Scan(src); err != nil {
 			return err
 		}
-		for rows.Next() {
-			s := Static{}
-			if err := rows.Scan(&s.Id, &s.Name, &s.Content); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					return nil
-				default:
-					log.Println(err.Error())
-					return err
-				}
+		n.field.SetInt(ni.Int64)
+	case reflect.Bool:
+		var nb sql.NullBool
+		if err := nb.Scan(src); err != nil {
+			return err
+		}
+		n.field.SetBool(nb.Bool)
+	case reflect.Ptr:
+		elem := reflect.New(n.field.Type().Elem())
+		if scanner, ok := elem.Interface().(sql.Scanner); ok {
+			if err := scanner.Scan(src); err != nil {
+				return err
+			}
+		} else if err := (nullField{field: elem.Elem()}).Scan(src); err != nil {
+			return err
+		}
+		n.field.Set(elem)
+	case reflect.Slice:
+		if n.field.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("cannot scan %T into field of type %s", src, n.field.Type())
+		}
+		var b []byte
+		switch v := src.(type) {
+		case []byte:
+			b = append(b, v...)
+		case string:
+			b = []byte(v)
+		default:
+			return fmt.Errorf("cannot scan %T into field of type %s", src, n.field.Type())
+		}
+		n.field.SetBytes(b)
+	default:
+		if n.field.Type() == reflect.TypeOf(time.Time{}) {
+			var nt sql.NullTime
+			if err := nt.Scan(src); err != nil {
+				return err
 			}
-			i.Static = append(i.Static, s)
-			i.Count = i.Count + 1
+			n.field.Set(reflect.ValueOf(nt.Time))
+			return nil
 		}
-	} else {
-		i.LastInsertId, err = setLastID(ctx, sqlStmnt, vals)
+		return fmt.Errorf("cannot scan %T into field of type %s", src, n.field.Type())
 	}
-	return err
+	return nil
+}
+func reflectFields(i reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	for name, field := range structFields(i.Type()) {
+		fields[name] = i.FieldByIndex(field.Index)
+	}
+	return fields
 }
 
+// reflectStruct returns the columns of i to write or match. Empty strings, ints of 0 (taskid below 0), unset DBTimes and nil pointers are left out. NULL is written with sql.Null fields or DBTime.Null
 func reflectStruct(i reflect.Value) map[string]interface{} {
 	params := make(map[string]interface{})
 	structType := i.Type()
@@ -821,6 +3944,9 @@ func reflectStruct(i reflect.Value) map[string]interface{} {
 		field := structType.Field(f)
 		fieldName := field.Name
 		fieldType := field.Type
+		if field.Tag.Get("db") == "-" {
+			continue
+		}
 		switch fieldType.Kind() {
 		case reflect.Int:
 			val := i.Field(f).Interface().(int)
@@ -842,6 +3968,48 @@ func reflectStruct(i reflect.Value) map[string]interface{} {
 					log.Printf("Reflected param %s : value %s", strings.ToLower(fieldName), i.Field(f).Interface().(string))
 				}
 			}
+		case reflect.Ptr:
+			if i.Field(f).IsNil() {
+				continue
+			}
+			val := i.Field(f).Elem().Interface()
+			if t, ok := val.(DBTime); ok {
+				val = t.Time
+			}
+			params[strings.ToLower(fieldName)] = val
+			log.Printf("Reflected param %s : value %v", strings.ToLower(fieldName), val)
+		case reflect.Slice:
+			if val, ok := i.Field(f).Interface().([]byte); ok {
+				if len(val) > 0 {
+					params[strings.ToLower(fieldName)] = val
+					log.Printf("Reflected param %s : value (%v bytes)", strings.ToLower(fieldName), len(val))
+				}
+				continue
+			}
+			log.Printf("Field %s has an unknown type %v\n", fieldName, fieldType)
+		case reflect.Struct:
+			if val, ok := i.Field(f).Interface().(DBTime); ok {
+				if val.Valid {
+					params[strings.ToLower(fieldName)] = val.Time
+					log.Printf("Reflected param %s : value %s", strings.ToLower(fieldName), val.String())
+				} else if val.Null {
+					params[strings.ToLower(fieldName)] = nil
+					log.Printf("Reflected param %s : value NULL", strings.ToLower(fieldName))
+				}
+				continue
+			}
+			// sql.NullString and the other sql.Null types are always written, as NULL when not Valid
+			if valuer, ok := i.Field(f).Interface().(driver.Valuer); ok {
+				val, err := valuer.Value()
+				if err != nil {
+					log.Println(err.Error())
+					continue
+				}
+				params[strings.ToLower(fieldName)] = val
+				log.Printf("Reflected param %s : value %v", strings.ToLower(fieldName), val)
+				continue
+			}
+			log.Printf("Field %s has an unknown type %v\n", fieldName, fieldType)
 		default:
 			log.Printf("Field %s has an unknown type %v\n", fieldName, fieldType.Kind())
 		}
@@ -875,6 +4043,10 @@ func createPreparedStmnt(action string, table string, params map[string]interfac
 			var paramStr string
 			stmntStr = stmntStr + " WHERE "
 			for param, val := range params {
+				if val == nil {
+					paramStr = paramStr + param + " IS NULL AND "
+					continue
+				}
 				paramStr = paramStr + param + "= ? AND "
 				vals = append(vals, val)
 			}
@@ -904,14 +4076,6 @@ func createPreparedStmnt(action string, table string, params map[string]interfac
 			}
 		case tukcnst.UPDATE:
 			switch table {
-			case tukcnst.WORKFLOWS:
-				stmntStr = "UPDATE workflows SET xdw_doc = ?, published = ?, status = ? WHERE pathway = ? AND nhsid = ? AND version = ?"
-				vals = append(vals, params["xdw_doc"])
-				vals = append(vals, params["published"])
-				vals = append(vals, params["status"])
-				vals = append(vals, params["pathway"])
-				vals = append(vals, params["nhsid"])
-				vals = append(vals, params["version"])
 			case tukcnst.ID_MAPS:
 				stmntStr = "UPDATE idmaps SET "
 				var paramStr string
@@ -929,6 +4093,10 @@ func createPreparedStmnt(action string, table string, params map[string]interfac
 			stmntStr = "DELETE FROM " + table + " WHERE "
 			var paramStr string
 			for param, val := range params {
+				if val == nil {
+					paramStr = paramStr + param + " IS NULL AND "
+					continue
+				}
 				paramStr = paramStr + param + "= ? AND "
 				vals = append(vals, val)
 			}
@@ -939,6 +4107,127 @@ func createPreparedStmnt(action string, table string, params map[string]interfac
 	}
 	return stmntStr, vals, nil
 }
+
+// replaceRow deletes the rows of table matching keys and inserts a row with keys and cols. Every column is written, even when empty. db should be a transaction so that the row is not lost if the insert fails
+func replaceRow(db dbExecutor, table string, keys map[string]interface{}, cols map[string]interface{}) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	var where string
+	var vals []interface{}
+	row := make(map[string]interface{})
+	for _, key := range batchColumns(keys) {
+		where = where + key + " = ? AND "
+		vals = append(vals, keys[key])
+		row[key] = keys[key]
+	}
+	where = strings.TrimSuffix(where, " AND ")
+	if _, err := auditRows(ctx, db, tukcnst.DELETE, table, where, vals, func(db dbExecutor) (int, error) {
+		_, err := execStmnt(ctx, db, "DELETE FROM "+table+" WHERE "+where, vals...)
+		return 0, dbError(err)
+	}); err != nil {
+		return err
+	}
+	for col, val := range cols {
+		row[col] = val
+	}
+	_, err := insertBatch(ctx, db, table, []map[string]interface{}{row})
+	return err
+}
+
+// upsert inserts the row reflected from i or updates the row with the same keys, which are always included. It returns true if a row was created
+func upsert(db dbExecutor, table string, i interface{}, keys ...string) (bool, error) {
+	if err := checkDBConn(db); err != nil {
+		return false, err
+	}
+	v := reflect.ValueOf(i)
+	params := reflectStruct(v)
+	fields := reflectFields(v)
+	for _, key := range keys {
+		if _, ok := params[key]; !ok {
+			field, ok := fields[key]
+			if !ok || field.Kind() == reflect.Int {
+				err := newDBError(ErrValidation, "upsert into %s requires a value for key %s", table, key)
+				return false, dbError(err)
+			}
+			params[key] = field.Interface()
+		}
+	}
+	return upsertParams(db, table, params, keys)
+}
+
+// upsertParams is upsert for the columns and values of params, which must include keys
+func upsertParams(db dbExecutor, table string, params map[string]interface{}, keys []string) (bool, error) {
+	stmntStr, vals := createUpsertStmnt(table, params, keys)
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return false, dbError(err)
+	}
+	defer sqlStmnt.Close()
+	var keyStr string
+	var keyVals []interface{}
+	for _, key := range keys {
+		if params[key] == nil {
+			keyStr = keyStr + key + " IS NULL AND "
+			continue
+		}
+		keyStr = keyStr + key + " = ? AND "
+		keyVals = append(keyVals, params[key])
+	}
+	// mysql reports 1 affected row for an insert, 2 for an update and 0 when the existing row was unchanged
+	var cnt int64
+	_, err = auditRows(ctx, db, tukcnst.UPDATE, table, strings.TrimSuffix(keyStr, " AND "), keyVals, func(db dbExecutor) (int, error) {
+		sqlrslt, err := bindStmnt(ctx, db, sqlStmnt).ExecContext(ctx, vals...)
+		if err != nil {
+			return 0, dbError(err)
+		}
+		if cnt, err = sqlrslt.RowsAffected(); err != nil {
+			return 0, dbError(err)
+		}
+		return 0, nil
+	})
+	return cnt == 1, err
+}
+func createUpsertStmnt(table string, params map[string]interface{}, keys []string) (string, []interface{}) {
+	var vals []interface{}
+	var paramStr string
+	var qStr string
+	var updStr string
+	cols := batchColumns(params)
+	for _, col := range cols {
+		paramStr = paramStr + col + ", "
+		qStr = qStr + "?, "
+		vals = append(vals, params[col])
+		isKey := col == "id"
+		for _, key := range keys {
+			isKey = isKey || col == key
+		}
+		if !isKey {
+			updStr = updStr + col + " = VALUES(" + col + "), "
+		}
+	}
+	if updStr == "" {
+		updStr = "id = id"
+	}
+	stmntStr := "INSERT INTO " + table + " (" + strings.TrimSuffix(paramStr, ", ") + ") VALUES (" + strings.TrimSuffix(qStr, ", ") + ") ON DUPLICATE KEY UPDATE " + strings.TrimSuffix(updStr, ", ")
+	log.Printf("Created Prepared Statement %s - Values %s", stmntStr, vals)
+	return stmntStr, vals
+}
+
+// execStmnt prepares and executes stmntStr, returning the unclassified driver error so callers can check for specific mysql errors
+func execStmnt(ctx context.Context, db dbExecutor, stmntStr string, vals ...interface{}) (sql.Result, error) {
+	if err := checkDBConn(db); err != nil {
+		return nil, err
+	}
+	log.Printf("Created Prepared Statement %s - Values %s", stmntStr, vals)
+	sqlStmnt, err := db.PrepareContext(ctx, stmntStr)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlStmnt.Close()
+	return sqlStmnt.ExecContext(ctx, vals...)
+}
 func setRows(ctx context.Context, sqlStmnt *sql.Stmt, vals []interface{}) (*sql.Rows, error) {
 	if len(vals) > 0 {
 		return sqlStmnt.QueryContext(ctx, vals...)
@@ -950,13 +4239,11 @@ func setLastID(ctx context.Context, sqlStmnt *sql.Stmt, vals []interface{}) (int
 	if len(vals) > 0 {
 		sqlrslt, err := sqlStmnt.ExecContext(ctx, vals...)
 		if err != nil {
-			log.Println(err.Error())
-			return 0, err
+			return 0, dbError(err)
 		}
 		id, err := sqlrslt.LastInsertId()
 		if err != nil {
-			log.Println(err.Error())
-			return 0, err
+			return 0, dbError(err)
 		} else {
 			return int(id), nil
 		}
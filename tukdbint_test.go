@@ -0,0 +1,759 @@
+package tukdbint
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/ipthomas/tukcnst"
+)
+
+func TestDBTimeJSON(t *testing.T) {
+	tm := time.Date(2024, 3, 1, 9, 30, 15, 0, time.UTC)
+	tests := []struct {
+		name string
+		json string
+		want DBTime
+		out  string
+	}{
+		{"rfc3339", `"2024-03-01T09:30:15Z"`, NewDBTime(tm), `"2024-03-01T09:30:15Z"`},
+		{"rfc3339 offset", `"2024-03-01T10:30:15+01:00"`, NewDBTime(tm), `"2024-03-01T09:30:15Z"`},
+		{"mysql datetime", `"2024-03-01 09:30:15"`, NewDBTime(tm), `"2024-03-01T09:30:15Z"`},
+		{"mysql date", `"2024-03-01"`, NewDBTime(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)), `"2024-03-01T00:00:00Z"`},
+		{"empty string", `""`, DBTime{}, `""`},
+		{"null", `null`, DBTime{Null: true}, `""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got DBTime
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+				t.Fatalf("unmarshal %s: %v", tt.json, err)
+			}
+			if got.Valid != tt.want.Valid || got.Null != tt.want.Null || !got.Time.Equal(tt.want.Time) {
+				t.Errorf("unmarshal %s = %+v, want %+v", tt.json, got, tt.want)
+			}
+			out, err := json.Marshal(got)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if string(out) != tt.out {
+				t.Errorf("marshal = %s, want %s", out, tt.out)
+			}
+		})
+	}
+}
+
+func TestDBTimeJSONInvalid(t *testing.T) {
+	var got DBTime
+	if err := json.Unmarshal([]byte(`"01/03/2024"`), &got); err == nil {
+		t.Errorf("unmarshal of invalid time = %+v, want error", got)
+	}
+}
+
+func TestDBTimeStringCompatible(t *testing.T) {
+	// entities marshalled before DBTime held time columns as strings, so old and new JSON must decode to the same struct
+	var old struct {
+		Created string `json:"created"`
+	}
+	var state Workflowstate
+	js := `{"created":"2024-03-01T09:30:15Z"}`
+	if err := json.Unmarshal([]byte(js), &old); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(js), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Created.String() != old.Created {
+		t.Errorf("created = %s, want %s", state.Created.String(), old.Created)
+	}
+}
+
+func TestSetSLA(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	created := NewDBTime(now.Add(-48 * time.Hour))
+	tests := []struct {
+		name  string
+		state Workflowstate
+		want  Workflowstate
+	}{
+		{"open no completeby",
+			Workflowstate{Status: "OPEN", Created: created},
+			Workflowstate{InProgress: "true", Overdue: "false", TargetMet: "false", Duration: "48h0m0s", TimeRemaining: ""}},
+		{"open on time",
+			Workflowstate{Status: "OPEN", Created: created, CompleteBy: NewDBTime(now.Add(2 * time.Hour))},
+			Workflowstate{InProgress: "true", Overdue: "false", TargetMet: "false", Duration: "48h0m0s", TimeRemaining: "2h0m0s"}},
+		{"open late",
+			Workflowstate{Status: "OPEN", Created: created, CompleteBy: NewDBTime(now.Add(-time.Hour))},
+			Workflowstate{InProgress: "true", Overdue: "true", TargetMet: "false", Duration: "48h0m0s", TimeRemaining: "0s"}},
+		{"complete on time",
+			Workflowstate{Status: "COMPLETE", Created: created, LastUpdate: NewDBTime(now.Add(-24 * time.Hour)), CompleteBy: NewDBTime(now.Add(-time.Hour))},
+			Workflowstate{InProgress: "false", Overdue: "false", TargetMet: "true", Duration: "24h0m0s", TimeRemaining: "0s"}},
+		{"complete late",
+			Workflowstate{Status: "CLOSED", Created: created, LastUpdate: NewDBTime(now.Add(-time.Hour)), CompleteBy: NewDBTime(now.Add(-2 * time.Hour))},
+			Workflowstate{InProgress: "false", Overdue: "false", TargetMet: "false", Duration: "47h0m0s", TimeRemaining: "0s"}},
+		{"complete no completeby",
+			Workflowstate{Status: "COMPLETE", Created: created, LastUpdate: NewDBTime(now)},
+			Workflowstate{InProgress: "false", Overdue: "false", TargetMet: "true", Duration: "48h0m0s", TimeRemaining: ""}},
+		{"no created",
+			Workflowstate{Status: "OPEN"},
+			Workflowstate{InProgress: "true", Overdue: "false", TargetMet: "false", Duration: "", TimeRemaining: ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.state
+			got.SetSLA(now)
+			if got.InProgress != tt.want.InProgress || got.Overdue != tt.want.Overdue || got.TargetMet != tt.want.TargetMet || got.Duration != tt.want.Duration || got.TimeRemaining != tt.want.TimeRemaining {
+				t.Errorf("SetSLA = inprogress %s overdue %s targetmet %s duration %s timeremaining %s, want %s %s %s %s %s",
+					got.InProgress, got.Overdue, got.TargetMet, got.Duration, got.TimeRemaining,
+					tt.want.InProgress, tt.want.Overdue, tt.want.TargetMet, tt.want.Duration, tt.want.TimeRemaining)
+			}
+		})
+	}
+}
+
+func TestEffectiveConfigs(t *testing.T) {
+	global := Config{Id: 1, Name: "timeout", Value: "global"}
+	service := Config{Id: 2, Service: "svc", Name: "timeout", Value: "service"}
+	org := Config{Id: 3, Org: "org", Name: "timeout", Value: "org"}
+	serviceOrg := Config{Id: 4, Service: "svc", Org: "org", Name: "timeout", Value: "service org"}
+	user := Config{Id: 5, User: "user", Name: "timeout", Value: "user"}
+	other := Config{Id: 6, Name: "retries", Value: "3"}
+	tests := []struct {
+		name    string
+		configs []Config
+		want    map[string]string
+	}{
+		{"none", nil, map[string]string{}},
+		{"global only", []Config{global}, map[string]string{"timeout": "global"}},
+		{"service over global", []Config{global, service}, map[string]string{"timeout": "service"}},
+		{"org over service", []Config{service, org, global}, map[string]string{"timeout": "org"}},
+		{"service and org over org", []Config{org, serviceOrg}, map[string]string{"timeout": "service org"}},
+		{"user over all", []Config{user, serviceOrg, org, service, global}, map[string]string{"timeout": "user"}},
+		{"names independent", []Config{user, other, global}, map[string]string{"timeout": "user", "retries": "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := effectiveConfigs(tt.configs)
+			if len(got) != len(tt.want) {
+				t.Fatalf("effectiveConfigs returned %v values, want %v", len(got), len(tt.want))
+			}
+			for name, value := range tt.want {
+				if got[name].Value != value {
+					t.Errorf("%s = %s, want %s", name, got[name].Value, value)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigWatcherZeroValueSubscribe(t *testing.T) {
+	var w ConfigWatcher
+	w.Subscribe("timeout", func(Config) {})
+	if len(w.subs["timeout"]) != 1 {
+		t.Errorf("subscribers = %v, want 1", len(w.subs["timeout"]))
+	}
+}
+
+func TestCreateUpsertStmnt(t *testing.T) {
+	tests := []struct {
+		name     string
+		table    string
+		params   map[string]interface{}
+		keys     []string
+		wantStmt string
+		wantVals []interface{}
+	}{
+		{"single key",
+			"statics", map[string]interface{}{"name": "logo.png", "contenttype": "image/png"}, []string{"name"},
+			"INSERT INTO statics (contenttype, name) VALUES (?, ?) ON DUPLICATE KEY UPDATE contenttype = VALUES(contenttype)",
+			[]interface{}{"image/png", "logo.png"}},
+		{"composite key",
+			"templates", map[string]interface{}{"name": "t1", "user": "", "template": "body"}, []string{"name", "user"},
+			"INSERT INTO templates (name, template, user) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE template = VALUES(template)",
+			[]interface{}{"t1", "body", ""}},
+		{"id never updated",
+			"idmaps", map[string]interface{}{"id": 7, "user": "u", "lid": "l", "mid": "m"}, []string{"user", "lid"},
+			"INSERT INTO idmaps (id, lid, mid, user) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE mid = VALUES(mid)",
+			[]interface{}{7, "l", "m", "u"}},
+		{"keys only",
+			"eventacks", map[string]interface{}{"eventid": 1, "user": "u"}, []string{"eventid", "user"},
+			"INSERT INTO eventacks (eventid, user) VALUES (?, ?) ON DUPLICATE KEY UPDATE id = id",
+			[]interface{}{1, "u"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmnt, vals := createUpsertStmnt(tt.table, tt.params, tt.keys)
+			if stmnt != tt.wantStmt {
+				t.Errorf("statement = %s, want %s", stmnt, tt.wantStmt)
+			}
+			if !reflect.DeepEqual(vals, tt.wantVals) {
+				t.Errorf("values = %v, want %v", vals, tt.wantVals)
+			}
+		})
+	}
+}
+
+func TestCreateBatchStmnt(t *testing.T) {
+	tests := []struct {
+		name     string
+		cols     []string
+		rows     []map[string]interface{}
+		wantStmt string
+		wantVals []interface{}
+	}{
+		{"one row",
+			[]string{"name", "value"}, []map[string]interface{}{{"name": "a", "value": "1"}},
+			"INSERT INTO config (name, value) VALUES (?, ?)",
+			[]interface{}{"a", "1"}},
+		{"rows in order",
+			[]string{"name", "value"}, []map[string]interface{}{{"name": "a", "value": "1"}, {"value": "2", "name": "b"}, {"name": "c", "value": nil}},
+			"INSERT INTO config (name, value) VALUES (?, ?), (?, ?), (?, ?)",
+			[]interface{}{"a", "1", "b", "2", "c", nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmnt, vals := createBatchStmnt("config", tt.cols, tt.rows)
+			if stmnt != tt.wantStmt {
+				t.Errorf("statement = %s, want %s", stmnt, tt.wantStmt)
+			}
+			if !reflect.DeepEqual(vals, tt.wantVals) {
+				t.Errorf("values = %v, want %v", vals, tt.wantVals)
+			}
+		})
+	}
+}
+
+func TestBatchColumns(t *testing.T) {
+	cols := batchColumns(map[string]interface{}{"value": "1", "name": "a", "id": 2})
+	if !reflect.DeepEqual(cols, []string{"id", "name", "value"}) {
+		t.Errorf("batchColumns = %v, want sorted columns", cols)
+	}
+	if !sameColumns(cols, map[string]interface{}{"name": "b", "id": 3, "value": "2"}) {
+		t.Error("sameColumns = false for the same columns")
+	}
+	if sameColumns(cols, map[string]interface{}{"name": "b", "value": "2"}) {
+		t.Error("sameColumns = true for fewer columns")
+	}
+	if sameColumns(cols, map[string]interface{}{"name": "b", "id": 3, "user": "2"}) {
+		t.Error("sameColumns = true for different columns")
+	}
+}
+
+func TestReadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []Migration
+		wantErr bool
+	}{
+		{"up and down paired and sorted",
+			fstest.MapFS{
+				"migrations/0002_add_column.up.sql":      {Data: []byte("ALTER 2")},
+				"migrations/0001_create_tables.up.sql":   {Data: []byte("CREATE 1")},
+				"migrations/0001_create_tables.down.sql": {Data: []byte("DROP 1")},
+				"migrations/0002_add_column.down.sql":    {Data: []byte("UNDO 2")},
+			},
+			[]Migration{{Version: 1, Name: "create_tables", Up: "CREATE 1", Down: "DROP 1"}, {Version: 2, Name: "add_column", Up: "ALTER 2", Down: "UNDO 2"}},
+			false},
+		{"other files ignored",
+			fstest.MapFS{
+				"migrations/0003_index.up.sql": {Data: []byte("ADD 3")},
+				"migrations/README.md":         {Data: []byte("notes")},
+			},
+			[]Migration{{Version: 3, Name: "index", Up: "ADD 3"}},
+			false},
+		{"name with underscores",
+			fstest.MapFS{"migrations/10_natural_keys_v2.up.sql": {Data: []byte("ADD")}},
+			[]Migration{{Version: 10, Name: "natural_keys_v2", Up: "ADD"}},
+			false},
+		{"invalid version",
+			fstest.MapFS{"migrations/first_create.up.sql": {Data: []byte("CREATE")}},
+			nil,
+			true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMigrations(tt.files)
+			if tt.wantErr {
+				if !errors.Is(err, ErrValidation) {
+					t.Errorf("error = %v, want ErrValidation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readMigrations = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMigrationsEmbedded(t *testing.T) {
+	migrations, err := GetMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for m, migration := range migrations {
+		if migration.Version != m+1 {
+			t.Errorf("migration %v has version %v, want consecutive versions", m, migration.Version)
+		}
+		if migration.Up == "" || migration.Down == "" {
+			t.Errorf("migration %v %s is missing its up or down statements", migration.Version, migration.Name)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no rows", sql.ErrNoRows, ErrNotFound},
+		{"duplicate key", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, ErrConflict},
+		{"lock wait timeout", &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, ErrRowLocked},
+		{"nowait", &mysql.MySQLError{Number: 3572, Message: "NOWAIT"}, ErrRowLocked},
+		{"deadlock", &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, ErrRowLocked},
+		{"row locked is a conflict", &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, ErrConflict},
+		{"context deadline", context.DeadlineExceeded, ErrTimeout},
+		{"net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, ErrTimeout},
+		{"bad connection", driver.ErrBadConn, ErrConnection},
+		{"invalid connection", mysql.ErrInvalidConn, ErrConnection},
+		{"access denied", &mysql.MySQLError{Number: 1045, Message: "Access denied"}, ErrConnection},
+		{"wrapped", fmt.Errorf("select: %w", sql.ErrNoRows), ErrNotFound},
+		{"already classified", newDBError(ErrValidation, "bad input"), ErrValidation},
+		{"revision conflict", &ConflictError{Table: "workflows", Revision: 1, CurrentRevision: 2}, ErrConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dbError(tt.err); !errors.Is(got, tt.want) {
+				t.Errorf("dbError(%v) = %v, want kind %v", tt.err, got, tt.want)
+			}
+		})
+	}
+	if dbError(nil) != nil {
+		t.Error("dbError(nil) != nil")
+	}
+	if err := errors.New("other"); dbError(err) != err {
+		t.Error("dbError changed an unclassified error")
+	}
+	if err := checkDBConn((*sql.DB)(nil)); !errors.Is(err, ErrConnection) {
+		t.Errorf("checkDBConn(nil) = %v, want ErrConnection", err)
+	}
+}
+
+func TestCheckRestart(t *testing.T) {
+	rows := []workflowVersion{{Id: 3, Version: 1, Revision: 2}, {Id: 7, Version: 0}}
+	tests := []struct {
+		name     string
+		existing []workflowVersion
+		wf       Workflow
+		wantErr  bool
+	}{
+		{"first start", nil, Workflow{XDW_Key: "k"}, false},
+		{"restart current", rows, Workflow{XDW_Key: "k", Id: 7}, false},
+		{"restart with no current row read", rows, Workflow{XDW_Key: "k"}, true},
+		{"stale second restart", []workflowVersion{{Id: 7, Version: 1}, {Id: 8, Version: 0}}, Workflow{XDW_Key: "k", Id: 7}, true},
+		{"updated since read", []workflowVersion{{Id: 7, Version: 0, Revision: 1}}, Workflow{XDW_Key: "k", Id: 7}, true},
+		{"started since read", []workflowVersion{{Id: 8, Version: 0}}, Workflow{XDW_Key: "k"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRestart(tt.existing, tt.wf)
+			if tt.wantErr != errors.Is(err, ErrConflict) || !tt.wantErr && err != nil {
+				t.Errorf("checkRestart = %v, want conflict %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		dbType string
+		val    []byte
+		want   string
+	}{
+		{"text", "VARCHAR", []byte("pathway"), "pathway"},
+		{"mediumtext", "MEDIUMTEXT", []byte("<xdw/>"), "<xdw/>"},
+		{"blob", "MEDIUMBLOB", []byte{0xff, 0x00}, "2 bytes sha256 ea5dbf9596d187e9500f23e9a680109475341cf4e81f7e043f7d97152c10772f"},
+		{"empty blob", "BLOB", nil, "0 bytes sha256 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auditBytes(tt.dbType, tt.val); got != tt.want {
+				t.Errorf("auditBytes = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeWatchId(t *testing.T) {
+	tests := []struct {
+		name   string
+		lastId int
+		step   int
+		ids    []watchId
+		want   int
+	}{
+		{"none", 5, 1, nil, 5},
+		{"consecutive", 5, 1, []watchId{{Id: 6}, {Id: 7}, {Id: 8}}, 8},
+		{"recent gap waits", 5, 1, []watchId{{Id: 6}, {Id: 8}, {Id: 9}}, 6},
+		{"settled gap skipped", 5, 1, []watchId{{Id: 6}, {Id: 8, Settled: true}, {Id: 9}}, 9},
+		{"many settled gaps", 0, 1, []watchId{{Id: 3, Settled: true}, {Id: 7, Settled: true}, {Id: 12, Settled: true}, {Id: 13}}, 13},
+		{"gap at start", 5, 1, []watchId{{Id: 7}}, 5},
+		{"increment", 4, 3, []watchId{{Id: 7}, {Id: 10}, {Id: 13}}, 13},
+		{"increment gap", 4, 3, []watchId{{Id: 7}, {Id: 13}}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := safeWatchId(tt.lastId, tt.step, tt.ids); got != tt.want {
+				t.Errorf("safeWatchId = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStatic(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name        string
+		static      string
+		contentType string
+		content     []byte
+		want        string
+	}{
+		{"given type kept", "logo.png", "image/x-custom", png, "image/x-custom"},
+		{"from extension", "style.css", "", []byte("body {}"), "text/css; charset=utf-8"},
+		{"detected from content", "logo", "", png, "image/png"},
+		{"detected text", "readme", "", []byte("plain words"), "text/plain; charset=utf-8"},
+		{"empty content", "empty", "", nil, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			static := newStatic(tt.static, tt.contentType, tt.content)
+			if static.ContentType != tt.want {
+				t.Errorf("content type = %s, want %s", static.ContentType, tt.want)
+			}
+			if static.Content == nil {
+				t.Error("content is nil, want empty content to be written")
+			}
+			if !static.ValidChecksum() {
+				t.Error("ValidChecksum = false for new static")
+			}
+		})
+	}
+}
+
+func TestValidChecksum(t *testing.T) {
+	static := newStatic("logo.png", "", []byte{0xff, 0x00, 0x7f})
+	static.Content = []byte{0xff, 0x00}
+	if static.ValidChecksum() {
+		t.Error("ValidChecksum = true for changed content")
+	}
+	js, err := json.Marshal(newStatic("logo.png", "", []byte{0xff, 0x00, 0x7f}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Static
+	if err = json.Unmarshal(js, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.ValidChecksum() {
+		t.Errorf("binary content did not survive JSON: %s", js)
+	}
+}
+
+func TestReflectFilter(t *testing.T) {
+	zero, no := 0, false
+	tests := []struct {
+		name   string
+		filter interface{}
+		want   map[string]interface{}
+	}{
+		{"workflow pathway only", WorkflowFilter{Pathway: "p"}, map[string]interface{}{"pathway": "p"}},
+		{"workflow version 0 and unpublished", WorkflowFilter{Pathway: "p", Version: &zero, Published: &no}, map[string]interface{}{"pathway": "p", "version": 0, "published": false}},
+		{"workflowstate any published", WorkflowstateFilter{Status: "OPEN"}, map[string]interface{}{"status": "OPEN"}},
+		{"xdw any meta", XDWFilter{Name: "x"}, map[string]interface{}{"name": "x"}},
+		{"xdw not meta", XDWFilter{IsXDSMeta: &no}, map[string]interface{}{"isxdsmeta": false}},
+		{"event any task", EventFilter{NhsId: "n"}, map[string]interface{}{"nhsid": "n"}},
+		{"event task 0", EventFilter{NhsId: "n", TaskId: &zero}, map[string]interface{}{"nhsid": "n", "taskid": 0}},
+		{"entity bools always matched", Workflow{Pathway: "p"}, map[string]interface{}{"pathway": "p", "published": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reflectStruct(reflect.ValueOf(tt.filter)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reflectStruct = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNullFieldScan(t *testing.T) {
+	var row struct {
+		Name    string
+		Count   int
+		Flag    bool
+		When    time.Time
+		Content []byte
+		Owner   *string
+		Version *int
+	}
+	v := reflect.ValueOf(&row).Elem()
+	when := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		field string
+		src   interface{}
+		want  interface{}
+	}{
+		{"Name", []byte("n"), "n"},
+		{"Name", nil, ""},
+		{"Count", int64(4), 4},
+		{"Count", []byte("5"), 5},
+		{"Count", nil, 0},
+		{"Flag", int64(1), true},
+		{"Flag", nil, false},
+		{"When", when, when},
+		{"When", nil, time.Time{}},
+		{"Content", []byte{0xff, 0x00}, []byte{0xff, 0x00}},
+		{"Content", nil, []byte(nil)},
+		{"Owner", []byte("o"), "o"},
+		{"Version", int64(0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.field, tt.src), func(t *testing.T) {
+			field := v.FieldByName(tt.field)
+			field.Set(reflect.Zero(field.Type()))
+			if err := (nullField{field: field}).Scan(tt.src); err != nil {
+				t.Fatal(err)
+			}
+			got := field.Interface()
+			if field.Kind() == reflect.Ptr {
+				got = field.Elem().Interface()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scanned %v, want %v", got, tt.want)
+			}
+		})
+	}
+	owner := "o"
+	row.Owner = &owner
+	if err := (nullField{field: v.FieldByName("Owner")}).Scan(nil); err != nil || row.Owner != nil {
+		t.Errorf("scanning NULL into a pointer = %v, %v, want nil", row.Owner, err)
+	}
+	if err := (nullField{field: v.FieldByName("Count")}).Scan("x"); err == nil {
+		t.Error("scanning a non number into an int did not fail")
+	}
+}
+
+func TestReflectStructNull(t *testing.T) {
+	var row struct {
+		Owner      sql.NullString
+		Retries    sql.NullInt64
+		Name       string
+		CompleteBy DBTime
+		LastUpdate DBTime
+	}
+	row.Retries = sql.NullInt64{Int64: 3, Valid: true}
+	row.CompleteBy = DBTime{Null: true}
+	got := reflectStruct(reflect.ValueOf(row))
+	want := map[string]interface{}{"owner": nil, "retries": int64(3), "completeby": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reflectStruct = %v, want %v", got, want)
+	}
+}
+
+func TestCreatePreparedStmntNull(t *testing.T) {
+	tests := []struct {
+		action   string
+		params   map[string]interface{}
+		wantStmt string
+		wantVals []interface{}
+	}{
+		{tukcnst.SELECT, map[string]interface{}{"completeby": nil}, "SELECT * FROM workflowstate WHERE completeby IS NULL", nil},
+		{tukcnst.SELECT, map[string]interface{}{"status": "OPEN"}, "SELECT * FROM workflowstate WHERE status= ?", []interface{}{"OPEN"}},
+		{tukcnst.DELETE, map[string]interface{}{"completeby": nil}, "DELETE FROM workflowstate WHERE completeby IS NULL", nil},
+		{tukcnst.INSERT, map[string]interface{}{"completeby": nil}, "INSERT INTO workflowstate (completeby) VALUES (?)", []interface{}{nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantStmt, func(t *testing.T) {
+			stmnt, vals, err := createPreparedStmnt(tt.action, WORKFLOWSTATE, tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stmnt != tt.wantStmt || !reflect.DeepEqual(vals, tt.wantVals) {
+				t.Errorf("createPreparedStmnt = %s %v, want %s %v", stmnt, vals, tt.wantStmt, tt.wantVals)
+			}
+		})
+	}
+}
+
+func TestCreateWorkflowUpdateStmnt(t *testing.T) {
+	const want = "UPDATE workflows SET xdw_doc = ?, published = ?, status = ?, revision = revision + 1 WHERE pathway = ? AND nhsid = ? AND version = ? AND revision = ?"
+	tests := []struct {
+		name     string
+		wf       Workflow
+		wantVals []interface{}
+	}{
+		{"current version never updated", Workflow{Pathway: "p", NHSId: "n", XDW_Doc: "doc", Status: "OPEN"}, []interface{}{"doc", false, "OPEN", "p", "n", 0, 0}},
+		{"older version", Workflow{Pathway: "p", NHSId: "n", XDW_Doc: "doc", Published: true, Status: "CLOSED", Version: 2, Revision: 5}, []interface{}{"doc", true, "CLOSED", "p", "n", 2, 5}},
+		{"empty values written", Workflow{Pathway: "p", NHSId: "n", Revision: 1}, []interface{}{"", false, "", "p", "n", 0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmnt, vals := createWorkflowUpdateStmnt(tt.wf)
+			if stmnt != want {
+				t.Errorf("statement = %s, want %s", stmnt, want)
+			}
+			if !reflect.DeepEqual(vals, tt.wantVals) {
+				t.Errorf("values = %v, want %v", vals, tt.wantVals)
+			}
+		})
+	}
+}
+
+func TestLockStmnt(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{0, "SELECT * FROM workflows WHERE id = ? FOR UPDATE NOWAIT"},
+		{5 * time.Second, "SELECT /*+ SET_VAR(innodb_lock_wait_timeout=5) */ * FROM workflows WHERE id = ? FOR UPDATE"},
+		{200 * time.Millisecond, "SELECT /*+ SET_VAR(innodb_lock_wait_timeout=1) */ * FROM workflows WHERE id = ? FOR UPDATE"},
+	}
+	for _, tt := range tests {
+		if got := lockStmnt("SELECT * FROM workflows WHERE id = ?", tt.timeout); got != tt.want {
+			t.Errorf("lockStmnt(%v) = %s, want %s", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestMappedId(t *testing.T) {
+	idmaps := []IdMap{
+		{User: "system", Lid: "pathway", Mid: "System Pathway"},
+		{User: "alice", Lid: "pathway", Mid: "Alice Pathway"},
+	}
+	tests := []struct {
+		user, lid, want string
+	}{
+		{"alice", "pathway", "Alice Pathway"},
+		{"bob", "pathway", "System Pathway"},
+		{"", "pathway", "System Pathway"},
+		{"alice", "other", "other"},
+	}
+	for _, tt := range tests {
+		if got := mappedId(idmaps, tt.user, tt.lid); got != tt.want {
+			t.Errorf("mappedId(%s, %s) = %s, want %s", tt.user, tt.lid, got, tt.want)
+		}
+	}
+}
+
+func TestScanDest(t *testing.T) {
+	var ev Event
+	dest := scanDest([]string{"ID", "pathway", "creationtime", "unknown"}, reflect.ValueOf(&ev).Elem())
+	if len(dest) != 4 {
+		t.Fatalf("got %v destinations, want 4", len(dest))
+	}
+	if err := dest[0].(sql.Scanner).Scan(int64(7)); err != nil || ev.Id != 7 {
+		t.Errorf("id scan = %v, %v, want 7", ev.Id, err)
+	}
+	if err := dest[1].(sql.Scanner).Scan([]byte("pathway")); err != nil || ev.Pathway != "pathway" {
+		t.Errorf("pathway scan = %v, %v, want pathway", ev.Pathway, err)
+	}
+	if _, ok := dest[2].(*DBTime); !ok {
+		t.Errorf("creationtime destination = %T, want *DBTime", dest[2])
+	}
+	if _, ok := dest[3].(*sql.RawBytes); !ok {
+		t.Errorf("unknown destination = %T, want *sql.RawBytes", dest[3])
+	}
+}
+
+func TestGroupTimeline(t *testing.T) {
+	events := []Event{
+		{Id: 1, Pathway: "a", Version: 0},
+		{Id: 2, Pathway: "b", Version: 0},
+		{Id: 3, Pathway: "a", Version: 1},
+		{Id: 4, Pathway: "a", Version: 0},
+	}
+	wfs := []Workflow{{Id: 10, Pathway: "a", Version: 0, Status: "CLOSED"}, {Id: 11, Pathway: "a", Version: 1, Status: "OPEN"}}
+	got := groupTimeline(events, wfs)
+	want := []TimelinePathway{
+		{Pathway: "a", Versions: []TimelineVersion{
+			{Version: 0, WorkflowId: 10, Status: "CLOSED", Events: []Event{events[0], events[3]}},
+			{Version: 1, WorkflowId: 11, Status: "OPEN", Events: []Event{events[2]}},
+		}},
+		{Pathway: "b", Versions: []TimelineVersion{
+			{Version: 0, Events: []Event{events[1]}},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupTimeline = %+v, want %+v", got, want)
+	}
+	if got := groupTimeline(nil, wfs); got != nil {
+		t.Errorf("groupTimeline(nil) = %+v, want nil", got)
+	}
+}
+
+func TestStructFields(t *testing.T) {
+	type row struct {
+		Id      int
+		Name    string `db:"Display_Name"`
+		Skipped string `db:"-"`
+		hidden  string
+	}
+	fields := structFields(reflect.TypeOf(row{}))
+	if len(fields) != 2 {
+		t.Errorf("got fields %v, want id and display_name", fields)
+	}
+	if f, ok := fields["id"]; !ok || f.Name != "Id" {
+		t.Errorf("id field = %v, %v", f.Name, ok)
+	}
+	if f, ok := fields["display_name"]; !ok || f.Name != "Name" {
+		t.Errorf("display_name field = %v, %v", f.Name, ok)
+	}
+}
+
+func TestCompatibleColumnType(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		dataType string
+		want     bool
+	}{
+		{"", "varchar", true},
+		{"", "datetime", true},
+		{"", "int", false},
+		{0, "bigint", true},
+		{0, "varchar", false},
+		{false, "tinyint", true},
+		{false, "int", false},
+		{[]byte{}, "blob", true},
+		{[]byte{}, "varchar", false},
+		{[]string{}, "blob", false},
+		{DBTime{}, "timestamp", true},
+		{time.Time{}, "datetime", true},
+		{DBTime{}, "varchar", false},
+		{struct{}{}, "datetime", false},
+	}
+	for _, tt := range tests {
+		if got := compatibleColumnType(reflect.TypeOf(tt.value), tt.dataType); got != tt.want {
+			t.Errorf("compatibleColumnType(%T, %s) = %v, want %v", tt.value, tt.dataType, got, tt.want)
+		}
+	}
+}